@@ -3,7 +3,6 @@ package data
 import (
 	"database/sql"
 	"database/sql/driver"
-	"fmt"
 	_ "github.com/lib/pq"
 	"strings"
 	"time"
@@ -38,43 +37,35 @@ func encodeName(name string) string {
 	return "\"" + strings.Replace(name, "\"", "\"\"", -1) + "\""
 }
 
-func encodeValue(value interface{}) string {
-	encodeStr := func(value string) string {
-		return "'" + strings.Replace(value, "'", "''", -1) + "'"
-	}
-
-	// time.String() result is recognizable by PostgreSQL
-	encodeTime := func(value time.Time) string {
-		return encodeStr(value.Format(time.RFC3339))
-	}
+// implemented by both *sql.DB and *sql.Tx
+type Handle interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
 
-	if time_, ok := value.(time.Time); ok {
-		return encodeTime(time_)
-	}
+type beginner interface {
+	Begin() (*sql.Tx, error)
+}
 
-	valuer, ok := value.(driver.Valuer)
+// Runs txFunc within a new transaction, or within the caller's one
+// if the handle is already a transaction.
+func Transact(handle Handle, txFunc func(handle Handle) error) error {
+	beginner, ok := handle.(beginner)
 	if !ok {
-		return encodeStr(fmt.Sprint(value))
+		return txFunc(handle)
 	}
 
-	val, err := valuer.Value()
+	tx, err := beginner.Begin()
 	if err != nil {
-		return encodeStr(fmt.Sprint(value))
-	}
-
-	if time_, ok := val.(time.Time); ok {
-		return encodeTime(time_)
+		return err
 	}
 
-	if val != nil {
-		return encodeStr(fmt.Sprint(val))
+	if err = txFunc(tx); err != nil {
+		tx.Rollback()
+		return err
 	}
 
-	return "NULL"
-}
-
-type Handle interface {
-	Query(query string, args ...interface{}) (*sql.Rows, error)
+	return tx.Commit()
 }
 
 func Open(connStr string) (*sql.DB, error) {
@@ -0,0 +1,49 @@
+package data
+
+import (
+	"github.com/lib/pq"
+	"time"
+)
+
+// Sends the notification when the handle's transaction commits.
+func Notify(handle Handle, channel, payload string) error {
+	_, err := handle.Exec("SELECT pg_notify($1, $2)", channel, payload)
+	return err
+}
+
+type Notification struct {
+	Channel string
+	Payload string
+}
+
+type Listener struct {
+	listener *pq.Listener
+}
+
+// Listens to the channels on a dedicated connection, which is
+// reestablished if lost (dropping the notifications meanwhile).
+func Listen(connStr string, channels ...string) (*Listener, error) {
+	listener := pq.NewListener(connStr, time.Second, time.Minute, nil)
+	for _, c := range channels {
+		if err := listener.Listen(c); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+
+	return &Listener{listener}, nil
+}
+
+// Blocks until the next notification, returns false once closed.
+func (listener *Listener) Receive() (Notification, bool) {
+	for n := range listener.listener.Notify {
+		if n != nil { // nil after reconnection
+			return Notification{n.Channel, n.Extra}, true
+		}
+	}
+	return Notification{}, false
+}
+
+func (listener *Listener) Close() error {
+	return listener.listener.Close()
+}
@@ -2,15 +2,27 @@ package data
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 )
 
+// sorted column names keep the statement text stable for reuse
+func sortedKeys(columns map[string]interface{}) []string {
+	var keys []string
+	for k := range columns {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func InsertRow(handle Handle, table string,
 	columns map[string]interface{}, id_column string) (int, error) {
+	var params params
 	var keys, values []string
-	for k, v := range columns {
+	for _, k := range sortedKeys(columns) {
 		keys = append(keys, encodeName(k))
-		values = append(values, encodeValue(v))
+		values = append(values, params.add(columns[k]))
 	}
 
 	ret := ""
@@ -21,15 +33,16 @@ func InsertRow(handle Handle, table string,
 	sql := fmt.Sprintf("INSERT INTO %s(%s) VALUES(%s)%s",
 		encodeName(table), strings.Join(keys, ", "),
 		strings.Join(values, ", "), ret)
-	rows, err := handle.Query(sql)
-	if err != nil {
+	if len(id_column) == 0 {
+		_, err := handle.Exec(sql, params...)
 		return 0, err
 	}
-	defer rows.Close()
 
-	if len(id_column) == 0 {
-		return 0, nil
+	rows, err := handle.Query(sql, params...)
+	if err != nil {
+		return 0, err
 	}
+	defer rows.Close()
 
 	var id int
 	rows.Next()
@@ -42,22 +55,40 @@ func InsertRow(handle Handle, table string,
 
 func UpdateRows(handle Handle, table string,
 	columns map[string]interface{}, where interface{}) error {
+	var params params
 	var assts []string
-	for k, v := range columns {
-		assts = append(assts, encodeName(k)+" = "+encodeValue(v))
+	for _, k := range sortedKeys(columns) {
+		assts = append(assts,
+			encodeName(k)+" = "+params.add(columns[k]))
 	}
 
 	sql := fmt.Sprintf("UPDATE %s SET %s",
 		encodeName(table), strings.Join(assts, ", "))
 
 	if where != nil {
-		expr, err := sqlExpr(where)
+		expr, err := sqlExpr(where, &params)
+		if err != nil {
+			return err
+		}
+		sql += " WHERE " + expr
+	}
+
+	_, err := handle.Exec(sql, params...)
+	return err
+}
+
+func DeleteRows(handle Handle, table string, where interface{}) error {
+	var params params
+	sql := fmt.Sprintf("DELETE FROM %s", encodeName(table))
+
+	if where != nil {
+		expr, err := sqlExpr(where, &params)
 		if err != nil {
 			return err
 		}
 		sql += " WHERE " + expr
 	}
 
-	_, err := handle.Query(sql)
+	_, err := handle.Exec(sql, params...)
 	return err
 }
@@ -32,15 +32,39 @@ type And struct {
 	Right interface{}
 }
 
+type Or struct {
+	Left  interface{}
+	Right interface{}
+}
+
+type IsNull struct {
+	Expr interface{}
+}
+
+type Not struct {
+	Expr interface{}
+}
+
 const ( // aggregate types
-	Max = iota
-	Min = iota
+	Max   = iota
+	Min   = iota
+	Avg   = iota
+	Last  = iota
+	Count = iota
 )
 
 type Aggr struct {
-	Table  string
-	Column string
-	Type   int
+	Table       string
+	Column      string
+	Type        int
+	OrderColumn string // defines the last row for `Last`
+}
+
+// column time rounded down to a multiple of Seconds
+type TimeBucket struct {
+	Table   string
+	Column  string
+	Seconds int
 }
 
 type Join struct {
@@ -57,8 +81,17 @@ type Order struct {
 
 func SelectRows(handle Handle,
 	columns interface{}, from []Join, where interface{},
-	groupBy []ColName, orderBy []Order, limit int) (*sql.Rows, error) {
-	cols, err := sqlExprList(columns)
+	groupBy interface{}, orderBy []Order, limit int) (*sql.Rows, error) {
+	return SelectGroups(handle, columns,
+		from, where, groupBy, nil, orderBy, limit)
+}
+
+// The same as SelectRows, but filters the groups by `having`.
+func SelectGroups(handle Handle, columns interface{},
+	from []Join, where interface{}, groupBy interface{},
+	having interface{}, orderBy []Order, limit int) (*sql.Rows, error) {
+	var params params
+	cols, err := sqlExprList(columns, &params)
 	if err != nil {
 		return nil, err
 	}
@@ -66,7 +99,7 @@ func SelectRows(handle Handle,
 	sql := fmt.Sprintf("SELECT %s FROM %s", cols, sqlFrom(from))
 
 	if where != nil {
-		expr, err := sqlExpr(where)
+		expr, err := sqlExpr(where, &params)
 		if err != nil {
 			return nil, err
 		}
@@ -74,10 +107,21 @@ func SelectRows(handle Handle,
 	}
 
 	if groupBy != nil {
-		cols, _ := sqlExprList(groupBy)
+		cols, err := sqlExprList(groupBy, &params)
+		if err != nil {
+			return nil, err
+		}
 		sql += " GROUP BY " + cols
 	}
 
+	if having != nil {
+		expr, err := sqlExpr(having, &params)
+		if err != nil {
+			return nil, err
+		}
+		sql += " HAVING " + expr
+	}
+
 	if orderBy != nil {
 		sql += " " + sqlOrderBy(orderBy)
 	}
@@ -86,16 +130,24 @@ func SelectRows(handle Handle,
 		sql += fmt.Sprintf(" LIMIT %d", limit)
 	}
 
-	return handle.Query(sql)
+	return handle.Query(sql, params...)
+}
+
+// query arguments referenced by `$n` placeholders
+type params []interface{}
+
+func (params *params) add(value interface{}) string {
+	*params = append(*params, value)
+	return fmt.Sprintf("$%d", len(*params))
 }
 
-func sqlExprList(list interface{}) (string, error) {
+func sqlExprList(list interface{}, params *params) (string, error) {
 	var strs []string
 	switch list.(type) {
 	case []interface{}:
 		lst := list.([]interface{})
 		for _, e := range lst {
-			str, err := sqlExpr(e)
+			str, err := sqlExpr(e, params)
 			if err != nil {
 				return "", err
 			}
@@ -104,13 +156,13 @@ func sqlExprList(list interface{}) (string, error) {
 	case []ColName:
 		lst := list.([]ColName)
 		for _, e := range lst {
-			str, _ := sqlExpr(e)
+			str, _ := sqlExpr(e, params)
 			strs = append(strs, str)
 		}
 	case []Aggr:
 		lst := list.([]Aggr)
 		for _, e := range lst {
-			str, err := sqlExpr(e)
+			str, err := sqlExpr(e, params)
 			if err != nil {
 				return "", err
 			}
@@ -123,15 +175,15 @@ func sqlExprList(list interface{}) (string, error) {
 	return strings.Join(strs, ", "), nil
 }
 
-func sqlExpr(expr interface{}) (string, error) {
+func sqlExpr(expr interface{}, params *params) (string, error) {
 	binaryOp := func(format string,
 		left, right interface{}) (string, error) {
 		var err error
 		var lstr, rstr string
-		if lstr, err = sqlExpr(left); err != nil {
+		if lstr, err = sqlExpr(left, params); err != nil {
 			return "", err
 		}
-		if rstr, err = sqlExpr(right); err != nil {
+		if rstr, err = sqlExpr(right, params); err != nil {
 			return "", err
 		}
 		return fmt.Sprintf(format, lstr, rstr), nil
@@ -139,13 +191,16 @@ func sqlExpr(expr interface{}) (string, error) {
 
 	switch expr.(type) {
 	case int, string, time.Time:
-		return encodeValue(expr), nil
+		return params.add(expr), nil
 	case ColName:
 		colName := expr.(ColName)
 		return colName.sqlDesc(), nil
 	case Aggr:
 		aggr := expr.(Aggr)
 		return aggr.sqlDesc()
+	case TimeBucket:
+		bucket := expr.(TimeBucket)
+		return bucket.sqlDesc(), nil
 	case Eq:
 		eq := expr.(Eq)
 		return binaryOp("(%s = %s)", eq.Left, eq.Right)
@@ -158,6 +213,21 @@ func sqlExpr(expr interface{}) (string, error) {
 	case And:
 		and := expr.(And)
 		return binaryOp("(%s AND %s)", and.Left, and.Right)
+	case Or:
+		or := expr.(Or)
+		return binaryOp("(%s OR %s)", or.Left, or.Right)
+	case IsNull:
+		str, err := sqlExpr(expr.(IsNull).Expr, params)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("(%s IS NULL)", str), nil
+	case Not:
+		str, err := sqlExpr(expr.(Not).Expr, params)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("(NOT %s)", str), nil
 	default:
 		return "", fmt.Errorf(
 			"data: unknown type (`%T`) in expression", expr)
@@ -207,6 +277,13 @@ func (aggr *Aggr) sqlDesc() (string, error) {
 		format = "MAX(%s)"
 	case Min:
 		format = "MIN(%s)"
+	case Avg:
+		format = "AVG(%s)"
+	case Last:
+		order := (&ColName{aggr.Table, aggr.OrderColumn}).sqlDesc()
+		format = "(ARRAY_AGG(%s ORDER BY " + order + " DESC))[1]"
+	case Count:
+		format = "COUNT(%s)"
 	default:
 		return "", fmt.Errorf("data: unknown aggregate type "+
 			"(%d) for column (`%s`)", aggr.Type, aggr.Column)
@@ -214,6 +291,12 @@ func (aggr *Aggr) sqlDesc() (string, error) {
 	return fmt.Sprintf(format, col), nil
 }
 
+func (bucket *TimeBucket) sqlDesc() string {
+	col := (&ColName{bucket.Table, bucket.Column}).sqlDesc()
+	return fmt.Sprintf("TO_TIMESTAMP(FLOOR(EXTRACT(EPOCH FROM %s) "+
+		"/ %d) * %d)", col, bucket.Seconds, bucket.Seconds)
+}
+
 func (order *Order) sqlDesc() string {
 	desc := (&ColName{order.Table, order.Column}).sqlDesc()
 	if order.Descending {
@@ -0,0 +1,71 @@
+package data
+
+import (
+	"database/sql"
+	"sync"
+)
+
+// Handle which prepares each distinct statement once and reuses it
+type StmtCache struct {
+	db    *sql.DB
+	mutex sync.Mutex
+	stmts map[string]*sql.Stmt
+}
+
+func NewStmtCache(db *sql.DB) *StmtCache {
+	return &StmtCache{db, sync.Mutex{}, make(map[string]*sql.Stmt)}
+}
+
+func (cache *StmtCache) prepare(query string) (*sql.Stmt, error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if stmt, ok := cache.stmts[query]; ok {
+		return stmt, nil
+	}
+
+	stmt, err := cache.db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	cache.stmts[query] = stmt
+
+	return stmt, nil
+}
+
+func (cache *StmtCache) Query(
+	query string, args ...interface{}) (*sql.Rows, error) {
+	stmt, err := cache.prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.Query(args...)
+}
+
+func (cache *StmtCache) Exec(
+	query string, args ...interface{}) (sql.Result, error) {
+	stmt, err := cache.prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.Exec(args...)
+}
+
+// transaction statements are not cached
+func (cache *StmtCache) Begin() (*sql.Tx, error) {
+	return cache.db.Begin()
+}
+
+func (cache *StmtCache) Close() error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	var err error
+	for query, stmt := range cache.stmts {
+		if err2 := stmt.Close(); err2 != nil && err == nil {
+			err = err2
+		}
+		delete(cache.stmts, query)
+	}
+	return err
+}
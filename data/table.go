@@ -42,13 +42,13 @@ func CreateTable(handle Handle, name string,
 
 	sql := fmt.Sprintf("CREATE TABLE %s(%s)",
 		encodeName(name), strings.Join(names, ", "))
-	if _, err := handle.Query(sql); err != nil {
+	if _, err := handle.Exec(sql); err != nil {
 		return err
 	}
 
 	for i := range indexes {
 		sql = "CREATE " + indexes[i].sqlDesc(name)
-		if _, err := handle.Query(sql); err != nil {
+		if _, err := handle.Exec(sql); err != nil {
 			return err
 		}
 	}
@@ -56,24 +56,29 @@ func CreateTable(handle Handle, name string,
 	return nil
 }
 
-func (column *Column) sqlDesc() (string, error) {
-	var desc = encodeName(column.Name)
-
+func (column *Column) sqlType() (string, error) {
 	switch column.Type {
 	case String:
-		desc += " varchar"
+		return "varchar", nil
 	case Integer:
 		if column.Flags&PrimaryKey != 0 {
-			desc += " serial"
-		} else {
-			desc += " int"
+			return "serial", nil
 		}
+		return "int", nil
 	case Time:
-		desc += " timestamp with time zone"
+		return "timestamp with time zone", nil
 	default:
 		return "", fmt.Errorf("data: unknown type (%d) "+
 			"for column (`%s`)", column.Type, column.Name)
 	}
+}
+
+func (column *Column) sqlDesc() (string, error) {
+	type_, err := column.sqlType()
+	if err != nil {
+		return "", err
+	}
+	var desc = encodeName(column.Name) + " " + type_
 
 	if column.Flags&PrimaryKey != 0 {
 		desc += " PRIMARY KEY"
@@ -105,8 +110,96 @@ func (index *Index) sqlDesc(table string) string {
 		encodeName(table), strings.Join(cols, ", "))
 }
 
+func CreateIndex(handle Handle, table string, index Index) error {
+	_, err := handle.Exec("CREATE " + index.sqlDesc(table))
+	return err
+}
+
 func DropTable(handle Handle, name string) error {
 	sql := fmt.Sprintf("DROP TABLE %s", encodeName(name))
-	_, err := handle.Query(sql)
+	_, err := handle.Exec(sql)
+	return err
+}
+
+// Blocks concurrent writes to the table until the transaction ends.
+func LockTable(handle Handle, name string) error {
+	sql := fmt.Sprintf("LOCK TABLE %s IN EXCLUSIVE MODE", encodeName(name))
+	_, err := handle.Exec(sql)
+	return err
+}
+
+func AddColumn(handle Handle, table string, column Column) error {
+	desc, err := column.sqlDesc()
+	if err != nil {
+		return err
+	}
+
+	sql := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s",
+		encodeName(table), desc)
+	_, err = handle.Exec(sql)
 	return err
 }
+
+// Adds the column unless the table has it already, filling it in
+// the existing rows with the default value (an SQL literal, NULL if
+// it's empty).
+func AddColumnIfMissing(handle Handle,
+	table string, column Column, default_ string) error {
+	desc, err := column.sqlDesc()
+	if err != nil {
+		return err
+	}
+	if len(default_) != 0 {
+		desc += " DEFAULT " + default_
+	}
+
+	sql := fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s",
+		encodeName(table), desc)
+	_, err = handle.Exec(sql)
+	return err
+}
+
+func HasTable(handle Handle, name string) (bool, error) {
+	rows, err := handle.Query(
+		"SELECT to_regclass($1) IS NOT NULL", encodeName(name))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	var exists bool
+	rows.Next()
+	err = rows.Scan(&exists)
+	return exists, err
+}
+
+// Converts the existing column values to the column's type,
+// which must accept all of them (e.g. integers converted to strings).
+func AlterColumnType(handle Handle, table string, column Column) error {
+	type_, err := column.sqlType()
+	if err != nil {
+		return err
+	}
+
+	name := encodeName(column.Name)
+	sql := fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s "+
+		"TYPE %s USING %s::%s", encodeName(table),
+		name, type_, name, type_)
+	_, err = handle.Exec(sql)
+	return err
+}
+
+// Maps a database type name (as reported by sql.ColumnType)
+// to a column type, returns -1 for unsupported ones.
+func ColumnTypeOf(databaseTypeName string) int {
+	switch databaseTypeName {
+	case "VARCHAR", "TEXT":
+		return String
+	case "INT4":
+		return Integer
+	case "TIMESTAMPTZ":
+		return Time
+	default:
+		return -1
+	}
+}
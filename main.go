@@ -7,6 +7,7 @@ import (
 	"database/sql"
 	"log"
 	"os"
+	"os/signal"
 	"time"
 )
 
@@ -61,6 +62,19 @@ func checkout(db *sql.DB) {
 	}
 }
 
+func poll(db *sql.DB) {
+	poller := mon.NewPoller(db, nil)
+	if err := poller.Start(); err != nil {
+		log.Fatalf("failed to start poller: %s", err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	<-signals
+
+	poller.Stop()
+}
+
 func main() {
 	config, err := NewConfig("config.json")
 	if err != nil {
@@ -76,5 +90,6 @@ func main() {
 
 	//install(db)
 	//commit(db)
+	//poll(db)
 	checkout(db)
 }
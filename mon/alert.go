@@ -0,0 +1,439 @@
+package mon
+
+import (
+	"btc/data"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const ( // rule conditions
+	RuleEquals  = iota // the field equals the rule value
+	RuleExceeds = iota // the integer field is greater than the value
+	RuleBelow   = iota // the integer field is less than the value
+)
+
+// Opens an alert for an element of the path once the condition holds
+// for its attribute (or value) for the given number of consecutive
+// commits and closes it when the condition no longer holds. Only the
+// changed fields are checked, out of order commits are not evaluated.
+type Rule struct {
+	id        int
+	Name      string
+	Schema    string
+	Path      string
+	Attr      string // empty for the element value
+	Condition int
+	Value     string
+	Commits   int // at least one
+}
+
+func NewRule(name, schema, path, attr string,
+	condition int, value string) *Rule {
+	return &Rule{0, name, schema, path, attr, condition, value, 1}
+}
+
+func (rule *Rule) column() string {
+	if len(rule.Attr) == 0 {
+		return "value"
+	}
+	return "attr_" + rule.Attr
+}
+
+func (rule *Rule) holds(change_ *Change) bool {
+	if change_.Type == ChangeRemoved {
+		return false
+	}
+
+	value, ok := change_.NewValue, true
+	if len(rule.Attr) != 0 {
+		value, ok = change_.NewAttrs[rule.Attr]
+	}
+	if !ok {
+		return false
+	}
+
+	if rule.Condition == RuleEquals {
+		return value == rule.Value
+	}
+
+	v, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return false
+	}
+	limit, err := strconv.ParseInt(rule.Value, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	if rule.Condition == RuleExceeds {
+		return v > limit
+	}
+	return v < limit
+}
+
+func AddRule(handle data.Handle, rule *Rule) error {
+	return data.Transact(handle, func(handle data.Handle) error {
+		return addRule(handle, rule)
+	})
+}
+
+func addRule(handle data.Handle, rule *Rule) error {
+	schema, err := FindSchema(handle, rule.Schema)
+	if err != nil {
+		return err
+	}
+
+	if err = checkRule(handle, schema, rule); err != nil {
+		return err
+	}
+
+	columns := map[string]interface{}{
+		"name":    rule.Name,
+		"schema":  schema.id,
+		"path":    rule.Path,
+		"attr":    rule.Attr,
+		"cond":    rule.Condition,
+		"value":   rule.Value,
+		"commits": rule.Commits,
+	}
+	rule.id, err = data.InsertRow(handle, "mon_rule", columns, "id")
+
+	return err
+}
+
+func checkRule(handle data.Handle, schema *Schema, rule *Rule) error {
+	if rule.Commits < 1 {
+		return fmt.Errorf("mon: rule (`%s`) commit count "+
+			"(`%d`) less than one", rule.Name, rule.Commits)
+	}
+
+	paths, err := findSchemaPaths(handle, schema.id)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if paths, err = livePaths(schema, paths, now, now); err != nil {
+		return err
+	}
+
+	var path *path
+	for _, p := range paths {
+		if p.path == rule.Path {
+			path = p
+		}
+	}
+	if path == nil {
+		return fmt.Errorf("mon: element path (`%s`) not found "+
+			"for schema (`%s`)", rule.Path, schema.Name)
+	}
+
+	type_, err := path.columnType(handle, rule.column())
+	if err != nil {
+		return err
+	}
+	if len(type_) == 0 {
+		return fmt.Errorf("mon: no field (`%s`) for "+
+			"element path (`%s`)", rule.column(), path.path)
+	}
+
+	switch rule.Condition {
+	case RuleEquals:
+		return nil
+	case RuleExceeds, RuleBelow:
+	default:
+		return fmt.Errorf("mon: unknown rule condition "+
+			"(`%d`)", rule.Condition)
+	}
+
+	if data.ColumnTypeOf(type_) != data.Integer {
+		return fmt.Errorf("mon: field (`%s`) for element "+
+			"path (`%s`) is not numeric", rule.column(), path.path)
+	}
+	if _, err = strconv.Atoi(rule.Value); err != nil {
+		return fmt.Errorf("mon: rule (`%s`) value (`%s`) "+
+			"is not an integer", rule.Name, rule.Value)
+	}
+
+	return nil
+}
+
+// Removes the rule along with its alerts.
+func RemoveRule(handle data.Handle, name string) error {
+	return data.Transact(handle, func(handle data.Handle) error {
+		return removeRule(handle, name)
+	})
+}
+
+func removeRule(handle data.Handle, name string) error {
+	rules, err := findRules(handle,
+		data.Eq{data.ColName{"mon_rule", "name"}, name})
+	if err != nil {
+		return err
+	}
+	if len(rules) == 0 {
+		return fmt.Errorf("mon: rule (`%s`) not found", name)
+	}
+
+	err = data.DeleteRows(handle, "mon_alert",
+		data.Eq{data.ColName{"", "rule"}, rules[0].id})
+	if err != nil {
+		return err
+	}
+
+	return data.DeleteRows(handle, "mon_rule",
+		data.Eq{data.ColName{"", "id"}, rules[0].id})
+}
+
+func findRules(handle data.Handle, where interface{}) ([]*Rule, error) {
+	rows, err := data.SelectRows(handle,
+		[]data.ColName{
+			{"mon_rule", "id"},
+			{"mon_rule", "name"},
+			{"mon_schema", "name"},
+			{"", "path"},
+			{"", "attr"},
+			{"", "cond"},
+			{"", "value"},
+			{"", "commits"}},
+		[]data.Join{
+			{"", "mon_rule", "schema"},
+			{"id", "mon_schema", ""}},
+		where, nil, []data.Order{{"mon_rule", "name", false}}, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []*Rule
+	for rows.Next() {
+		var rule Rule
+		if err = rows.Scan(&rule.id, &rule.Name, &rule.Schema,
+			&rule.Path, &rule.Attr, &rule.Condition,
+			&rule.Value, &rule.Commits); err != nil {
+			return nil, err
+		}
+		rules = append(rules, &rule)
+	}
+
+	return rules, rows.Err()
+}
+
+func ListRules(handle data.Handle, schema string) ([]*Rule, error) {
+	return findRules(handle,
+		data.Eq{data.ColName{"mon_schema", "name"}, schema})
+}
+
+type Alert struct {
+	Rule   string
+	Doc    string
+	Path   string
+	Parent string // parent's monId value
+	MonId  string // element's monId value
+	Open   time.Time
+	Close  data.NullTime // invalid while the alert is open
+}
+
+// Returns the alerts (of all the documents if the name is empty)
+// which were open at some moment within [from, to].
+func Alerts(handle data.Handle,
+	name string, from, to time.Time) ([]Alert, error) {
+	var where interface{} = data.And{
+		data.Ge{to, data.ColName{"mon_alert", "otime"}},
+		data.Or{data.IsNull{data.ColName{"mon_alert", "ctime"}},
+			data.Ge{data.ColName{"mon_alert", "ctime"}, from}}}
+	if len(name) != 0 {
+		where = data.And{where,
+			data.Eq{data.ColName{"mon_doc", "name"}, name}}
+	}
+
+	rows, err := data.SelectRows(handle,
+		[]data.ColName{
+			{"mon_rule", "name"},
+			{"mon_doc", "name"},
+			{"mon_rule", "path"},
+			{"mon_alert", "parent"},
+			{"mon_alert", "mon_id"},
+			{"mon_alert", "otime"},
+			{"mon_alert", "ctime"}},
+		[]data.Join{
+			{"", "mon_rule", "id"},
+			{"rule", "mon_alert", "doc"},
+			{"id", "mon_doc", ""}},
+		where, nil, []data.Order{{"mon_alert", "otime", false}}, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var alerts []Alert
+	for rows.Next() {
+		var alert Alert
+		if err = rows.Scan(&alert.Rule, &alert.Doc, &alert.Path,
+			&alert.Parent, &alert.MonId, &alert.Open,
+			&alert.Close); err != nil {
+			return nil, err
+		}
+		alerts = append(alerts, alert)
+	}
+
+	return alerts, rows.Err()
+}
+
+type alertKey struct {
+	rule   int
+	parent string
+	monId  string
+}
+
+// an alert not closed yet
+type activeAlert struct {
+	id    int
+	stime time.Time // since the condition holds
+	otime data.NullTime
+}
+
+func alertWhere(alert *activeAlert) interface{} {
+	return data.Eq{data.ColName{"", "id"}, alert.id}
+}
+
+func findActiveAlerts(handle data.Handle,
+	doc int) (map[alertKey]*activeAlert, error) {
+	rows, err := data.SelectRows(handle,
+		[]data.ColName{{"", "id"}, {"", "rule"}, {"", "parent"},
+			{"", "mon_id"}, {"", "stime"}, {"", "otime"}},
+		[]data.Join{{"", "mon_alert", ""}},
+		data.And{data.Eq{data.ColName{"", "doc"}, doc},
+			data.IsNull{data.ColName{"", "ctime"}}},
+		nil, nil, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	alerts := make(map[alertKey]*activeAlert)
+	for rows.Next() {
+		var key alertKey
+		var alert activeAlert
+		if err = rows.Scan(&alert.id, &key.rule, &key.parent,
+			&key.monId, &alert.stime, &alert.otime); err != nil {
+			return nil, err
+		}
+		alerts[key] = &alert
+	}
+
+	return alerts, rows.Err()
+}
+
+// opens and closes the alerts according to the changes of the commit
+func evaluateRules(handle data.Handle, schema *Schema,
+	doc *Doc, now time.Time, changes []Change) error {
+	rules, err := findRules(handle,
+		data.Eq{data.ColName{"mon_rule", "schema"}, schema.id})
+	if err != nil || len(rules) == 0 {
+		return err
+	}
+
+	active, err := findActiveAlerts(handle, doc.id)
+	if err != nil {
+		return err
+	}
+
+	for i := range changes {
+		c := &changes[i]
+		for _, r := range rules {
+			if r.Path != c.Path {
+				continue
+			}
+
+			key := alertKey{r.id, c.Parent, c.MonId}
+			alert, ok := active[key]
+			holds := r.holds(c)
+			switch {
+			case holds && !ok:
+				columns := map[string]interface{}{
+					"rule":   r.id,
+					"doc":    doc.id,
+					"parent": c.Parent,
+					"mon_id": c.MonId,
+					"stime":  now,
+				}
+				if r.Commits == 1 {
+					columns["otime"] = now
+				}
+				_, err = data.InsertRow(
+					handle, "mon_alert", columns, "")
+			case !holds && ok && alert.otime.Valid:
+				err = data.UpdateRows(handle, "mon_alert",
+					map[string]interface{}{"ctime": now},
+					alertWhere(alert))
+			case !holds && ok:
+				err = data.DeleteRows(handle,
+					"mon_alert", alertWhere(alert))
+			}
+			if err != nil {
+				return err
+			}
+			if !holds {
+				delete(active, key)
+			}
+		}
+	}
+
+	commits := make(map[int]int)
+	for _, r := range rules {
+		commits[r.id] = r.Commits
+	}
+
+	// pending ones open once the condition holds long enough
+	for key, alert := range active {
+		if alert.otime.Valid {
+			continue
+		}
+
+		var count int
+		count, err = countCommits(handle, doc, alert.stime, now)
+		if err != nil {
+			return err
+		}
+		if count < commits[key.rule] {
+			continue
+		}
+
+		err = data.UpdateRows(handle, "mon_alert",
+			map[string]interface{}{"otime": now}, alertWhere(alert))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// the number of the document commits within [from, to]
+// (not counting the forced snapshots, which have no input)
+func countCommits(handle data.Handle,
+	doc *Doc, from, to time.Time) (int, error) {
+	rows, err := data.SelectGroups(handle,
+		[]data.Aggr{{"", "id", data.Count, ""}},
+		[]data.Join{{"", "mon_commit", ""}},
+		data.And{data.And{data.Eq{data.ColName{"", "doc"}, doc.id},
+			data.Eq{data.ColName{"", "forced"}, 0}},
+			data.And{data.Ge{data.ColName{"", "time"}, from},
+				data.Ge{to, data.ColName{"", "time"}}}},
+		nil, nil, nil, -1)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var count int
+	if rows.Next() {
+		if err = rows.Scan(&count); err != nil {
+			return 0, err
+		}
+	}
+
+	return count, rows.Err()
+}
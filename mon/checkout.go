@@ -2,105 +2,463 @@ package mon
 
 import (
 	"btc/data"
+	"encoding/json"
 	"encoding/xml"
-	//"fmt"
+	"fmt"
 	"io"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
 func CheckoutDoc(handle data.Handle,
 	name string, timestamp time.Time,
 	writer io.Writer, prefix, indent string) error {
-	doc, err := FindDoc(handle, name)
+	return CheckoutSubtree(handle, name,
+		"", timestamp, writer, prefix, indent)
+}
+
+// Writes only the elements matching the selector (like
+// `/etr/input[@id=3]/check`) along with their subtrees and
+// ancestors, the whole document if the selector is empty.
+// Nothing is written for the moments before the first snapshot
+// (as for the other checkouts and queries).
+func CheckoutSubtree(handle data.Handle,
+	name, selector string, timestamp time.Time,
+	writer io.Writer, prefix, indent string) error {
+	checkout, err := loadCheckout(handle, name, selector, timestamp)
 	if err != nil {
 		return err
 	}
 
-	schema, err := FindSchema(handle, doc.Schema)
+	return checkout.WriteXML(writer, prefix, indent)
+}
+
+// Writes the document as a JSON object (see Checkout.WriteJSON),
+// the selector is as for CheckoutSubtree.
+func CheckoutDocJSON(handle data.Handle, name, selector string,
+	timestamp time.Time, writer io.Writer, monIdObjects bool) error {
+	checkout, err := loadCheckout(handle, name, selector, timestamp)
 	if err != nil {
 		return err
 	}
 
-	var paths []*path
-	paths, err = findSchemaPaths(handle, schema.id)
+	return checkout.WriteJSON(writer, monIdObjects)
+}
+
+// The document state at the given time.
+type Checkout struct {
+	Time     time.Time
+	handle   data.Handle
+	doc      int
+	snapshot time.Time // the last one not after Time
+	paths    []*path
+	state    docState
+}
+
+func (checkout *Checkout) WriteXML(
+	writer io.Writer, prefix, indent string) error {
+	encoder := xml.NewEncoder(writer)
+	encoder.Indent(prefix, indent)
+
+	err := checkout.encode(&xmlEncoder{encoder})
 	if err != nil {
 		return err
 	}
 
+	return encoder.Flush()
+}
+
+// Writes the document as a JSON object with elements keyed by name,
+// their attributes by `@` prefixed names and values (even recorded
+// empty ones) by `#text`. The elements having `monId` are put into
+// arrays or (if requested) into objects keyed by their `monId`
+// values. Integer fields are numbers.
+func (checkout *Checkout) WriteJSON(
+	writer io.Writer, monIdObjects bool) error {
+	encoder := jsonEncoder{checkout.handle, monIdObjects,
+		[]map[string]interface{}{{}}}
+	if err := checkout.encode(&encoder); err != nil {
+		return err
+	}
+
+	return json.NewEncoder(writer).Encode(encoder.stack[0])
+}
+
+func (checkout *Checkout) encode(encoder checkoutEncoder) error {
+	context := checkoutContext{checkout.handle, checkout.doc,
+		checkout.snapshot, checkout.Time, encoder, checkout.state}
+	return checkoutPathTree(&context, checkout.paths, "")
+}
+
+func loadCheckout(handle data.Handle, name, selector string,
+	timestamp time.Time) (*Checkout, error) {
+	doc, _, paths, err := findDocPaths(
+		handle, name, timestamp, timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	preds := make(map[string]*selectorStep)
+	if len(selector) != 0 {
+		var steps []selectorStep
+		if steps, err = parseSelector(selector); err != nil {
+			return nil, err
+		}
+		if paths, preds, err = selectPaths(paths, steps); err != nil {
+			return nil, err
+		}
+	}
+
 	var snapshot time.Time
-	snapshot, err = findSnapshot(handle, paths[0], doc, timestamp)
+	snapshot, err = findStartSnapshot(handle, paths[0], doc, timestamp)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	encoder := xml.NewEncoder(writer)
-	encoder.Indent(prefix, indent)
+	byPath := make(map[string]*path)
+	for _, p := range paths {
+		byPath[p.path] = p
+	}
 
 	docState := make(docState)
 	for _, p := range paths {
-		docState[p], err = computePathState(
-			handle, p, doc.id, snapshot, timestamp)
+		parent := byPath[p.path[:strings.LastIndex(p.path, "/")]]
+		docState[p], err = computeSelectedPathState(handle,
+			p, parent, doc.id, snapshot, timestamp, preds)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	context := checkoutContext{handle, doc.id,
-		writer, snapshot, timestamp, encoder, docState}
-	err = checkoutPathTree(&context, paths, "")
+	return &Checkout{timestamp, handle,
+		doc.id, snapshot, paths, docState}, nil
+}
+
+// Invokes the function with the document state at each of the times
+// (in ascending order), reading the events only once. The state
+// passed is valid only until the function returns (and is empty
+// before the first snapshot).
+func CheckoutRange(handle data.Handle, name string,
+	times []time.Time, fn func(checkout *Checkout) error) error {
+	if len(times) == 0 {
+		return nil
+	}
+
+	sorted := append([]time.Time{}, times...)
+	sort.Sort(timeSlice(sorted))
+	first, last := sorted[0], sorted[len(sorted)-1]
+
+	doc, schema, paths, err := findDocPaths(handle, name, first, last)
+	if err != nil {
+		return err
+	}
+
+	var snapshot time.Time
+	snapshot, err = findStartSnapshot(handle, paths[0], doc, first)
 	if err != nil {
 		return err
 	}
 
-	return context.encoder.Flush()
+	// the later snapshots replace the whole state
+	var snapshots []time.Time
+	snapshots, err = findEventTimes(
+		handle, paths[0], doc, snapshot, last, true)
+	if err != nil {
+		return err
+	}
+
+	events := make(map[*path][]event)
+	for _, p := range paths {
+		events[p], err = findPathEvents(
+			handle, p.id, doc.id, snapshot, last, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	state := make(docState)
+	next := make(map[*path]int)
+	// applies the events before (or also at) the given time
+	advance := func(to time.Time, inclusive bool) {
+		for _, p := range paths {
+			if _, ok := state[p]; !ok {
+				state[p] = make(pathState)
+			}
+			k, pathEvents := next[p], events[p]
+			for ; k < len(pathEvents); k += 1 {
+				e := &pathEvents[k]
+				if e.time.After(to) ||
+					!inclusive && e.time.Equal(to) {
+					break
+				}
+				applyEvent(state[p], p, e)
+			}
+			next[p] = k
+		}
+	}
+
+	for _, t := range sorted {
+		for len(snapshots) != 0 && !snapshots[0].After(t) {
+			advance(snapshots[0], false)
+			state, snapshot = make(docState), snapshots[0]
+			snapshots = snapshots[1:]
+		}
+		advance(t, true)
+
+		var live []*path
+		if live, err = livePaths(schema, paths, t, t); err != nil {
+			return err
+		}
+
+		err = fn(&Checkout{t, handle, doc.id, snapshot, live, state})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Loads only the elements matching the path's predicate and (if
+// the parent path predicate is on its `monId`) the parent one.
+// Children of the elements not loaded are not checked out anyway.
+func computeSelectedPathState(handle data.Handle,
+	path, parent *path, doc int, from, to time.Time,
+	preds map[string]*selectorStep) (pathState, error) {
+	var filter interface{}
+	if parent != nil {
+		pred, ok := preds[parent.path]
+		if ok && pred.attr == parent.monId.String {
+			filter = data.Eq{data.ColName{"", "parent"}, pred.value}
+		}
+	}
+
+	pred, ok := preds[path.path]
+	if ok {
+		has, err := path.hasColumn(handle, "attr_"+pred.attr)
+		if err != nil {
+			return nil, err
+		}
+		if !has {
+			return nil, fmt.Errorf("mon: attribute (`%s`) not "+
+				"found for element path (`%s`)",
+				pred.attr, path.path)
+		}
+	}
+
+	// other attributes are missing in removal events
+	byMonId := ok && pred.attr == path.monId.String
+	if byMonId {
+		monIdWhere := data.Eq{data.ColName{
+			"", "attr_" + pred.attr}, pred.value}
+		if filter != nil {
+			filter = data.And{filter, monIdWhere}
+		} else {
+			filter = monIdWhere
+		}
+	}
+
+	state, err := computeFilteredPathState(
+		handle, path, doc, from, to, filter)
+	if err != nil || !ok || byMonId {
+		return state, err
+	}
+
+	for _, parentState := range state {
+		for monIdVal, element := range parentState {
+			if v, ok := element.attrs[pred.attr]; !ok ||
+				v != pred.value {
+				delete(parentState, monIdVal)
+			}
+		}
+	}
+
+	return state, nil
+}
+
+// receives the elements of the reconstructed document in order
+type checkoutEncoder interface {
+	startElement(name string, path *path, element *element) error
+	endElement(name string, path *path, element *element) error
+}
+
+type xmlEncoder struct {
+	encoder *xml.Encoder
+}
+
+func (encoder *xmlEncoder) startElement(
+	name string, path *path, element *element) error {
+	start := xml.StartElement{xml.Name{"", name}, nil}
+	for _, n := range sortedAttrNames(element.attrs) {
+		attr := xml.Attr{xml.Name{"", n}, element.attrs[n]}
+		start.Attr = append(start.Attr, attr)
+	}
+
+	return encoder.encoder.EncodeToken(start)
+}
+
+func (encoder *xmlEncoder) endElement(
+	name string, path *path, element *element) error {
+	if len(element.value) != 0 {
+		data := xml.CharData(element.value)
+		if err := encoder.encoder.EncodeToken(data); err != nil {
+			return err
+		}
+	}
+
+	return encoder.encoder.EncodeToken(xml.EndElement{xml.Name{"", name}})
+}
+
+type jsonEncoder struct {
+	handle       data.Handle
+	monIdObjects bool
+	stack        []map[string]interface{} // the root object first
+}
+
+func (encoder *jsonEncoder) startElement(
+	name string, path *path, element *element) error {
+	object := make(map[string]interface{})
+	for n, v := range element.attrs {
+		value, err := encoder.typed(path, "attr_"+n, v)
+		if err != nil {
+			return err
+		}
+		object["@"+n] = value
+	}
+
+	if element.valued || len(element.value) != 0 {
+		value, err := encoder.typed(path, "value", element.value)
+		if err != nil {
+			return err
+		}
+		object["#text"] = value
+	}
+
+	parent := encoder.stack[len(encoder.stack)-1]
+	switch {
+	case !path.monId.Valid:
+		parent[name] = object
+	case encoder.monIdObjects:
+		siblings, ok := parent[name].(map[string]interface{})
+		if !ok {
+			siblings = make(map[string]interface{})
+			parent[name] = siblings
+		}
+		siblings[element.attrs[path.monId.String]] = object
+	default:
+		siblings, _ := parent[name].([]interface{})
+		parent[name] = append(siblings, object)
+	}
+
+	encoder.stack = append(encoder.stack, object)
+	return nil
+}
+
+func (encoder *jsonEncoder) endElement(
+	name string, path *path, element *element) error {
+	encoder.stack = encoder.stack[:len(encoder.stack)-1]
+	return nil
+}
+
+// the field value as a number if its column is an integer one
+func (encoder *jsonEncoder) typed(
+	path *path, column, value string) (interface{}, error) {
+	type_, err := path.columnType(encoder.handle, column)
+	if err != nil || data.ColumnTypeOf(type_) != data.Integer {
+		return value, err
+	}
+
+	number, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return value, nil // e.g. stored before the column retyping
+	}
+	return number, nil
 }
 
 type checkoutContext struct {
 	handle       data.Handle
 	doc          int
-	writer       io.Writer
 	lastSnapshot time.Time
 	timestamp    time.Time
-	encoder      *xml.Encoder
+	encoder      checkoutEncoder
 	state        docState
 }
 
+type checkoutItem struct {
+	paths    []*path
+	group    int
+	monIdVal string
+	element  *element
+}
+
+// Orders items by recorded position, falling back to
+// the schema path order and then to the monId value.
+type checkoutItems []checkoutItem
+
+func (items checkoutItems) Len() int {
+	return len(items)
+}
+
+func (items checkoutItems) Swap(i, j int) {
+	items[i], items[j] = items[j], items[i]
+}
+
+func (items checkoutItems) Less(i, j int) bool {
+	a, b := &items[i], &items[j]
+	if (a.element.pos < 0) != (b.element.pos < 0) {
+		return a.element.pos >= 0
+	}
+	if a.element.pos != b.element.pos {
+		return a.element.pos < b.element.pos
+	}
+	if a.group != b.group {
+		return a.group < b.group
+	}
+	return a.monIdVal < b.monIdVal
+}
+
 func checkoutPathTree(
 	context *checkoutContext, paths []*path, parent string) error {
-	base, pathGroups := groupPaths(paths)
-	start := xml.StartElement{xml.Name{"", base}, nil}
-	end := xml.EndElement{xml.Name{"", base}}
+	return checkoutGroups(context, [][]*path{paths}, parent)
+}
 
-	for monIdVal, element := range context.state[paths[0]][parent] {
-		start.Attr = nil
-		for n, v := range element.attrs {
-			attr := xml.Attr{xml.Name{"", n}, v}
-			start.Attr = append(start.Attr, attr)
+// writes the elements of all the path groups having the given parent
+func checkoutGroups(context *checkoutContext,
+	pathGroups [][]*path, parent string) error {
+	var items checkoutItems
+	for i, g := range pathGroups {
+		for monIdVal, element := range context.state[g[0]][parent] {
+			items = append(items,
+				checkoutItem{g, i, monIdVal, element})
 		}
+	}
+	sort.Sort(items)
 
-		if err := context.encoder.EncodeToken(start); err != nil {
+	for _, item := range items {
+		err := checkoutElement(context,
+			item.paths, item.monIdVal, item.element)
+		if err != nil {
 			return err
 		}
+	}
 
-		for _, g := range pathGroups {
-			err := checkoutPathTree(context, g, monIdVal)
-			if err != nil {
-				return err
-			}
-		}
+	return nil
+}
 
-		if len(element.value) != 0 {
-			data := xml.CharData(element.value)
-			err := context.encoder.EncodeToken(data)
-			if err != nil {
-				return err
-			}
-		}
+func checkoutElement(context *checkoutContext,
+	paths []*path, monIdVal string, element *element) error {
+	base, pathGroups := groupPaths(paths)
+	err := context.encoder.startElement(base, paths[0], element)
+	if err != nil {
+		return err
+	}
 
-		if err := context.encoder.EncodeToken(end); err != nil {
-			return err
-		}
+	if err = checkoutGroups(
+		context, pathGroups, monIdVal); err != nil {
+		return err
 	}
 
-	return nil
+	return context.encoder.endElement(base, paths[0], element)
 }
@@ -5,38 +5,111 @@ import (
 	"encoding/xml"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
 	"time"
 )
 
+type CommitOptions struct {
+	Snapshot   bool // commit a full snapshot
+	OutOfOrder bool // allow committing before the last update
+	DryRun     bool // only compute the changes, writing nothing
+}
+
+// Commits all the changes atomically, joining the handle's
+// transaction if there is one.
 func CommitDoc(handle data.Handle,
 	name string, reader io.Reader, snapshot bool) error {
-	doc, err := FindDoc(handle, name)
-	if err != nil {
+	_, err := CommitDocAt(handle, name,
+		reader, time.Now(), &CommitOptions{snapshot, false, false})
+	return err
+}
+
+// Commits the document as of the given time, which must be after
+// the document last update time unless committing out of order.
+// In the latter case the later commits are rewritten to stay
+// consistent with the inserted one (unless it's a dry run).
+// Returns the changes made to the state at the given time.
+func CommitDocAt(handle data.Handle, name string, reader io.Reader,
+	at time.Time, options *CommitOptions) ([]Change, error) {
+	var changes []Change
+	err := data.Transact(handle, func(handle data.Handle) error {
+		var err error
+		changes, err = commitDoc(handle, name, reader,
+			at.Truncate(time.Microsecond), options)
 		return err
+	})
+	return changes, err
+}
+
+func commitDoc(handle data.Handle, name string, reader io.Reader,
+	now time.Time, options *CommitOptions) ([]Change, error) {
+	if options == nil {
+		options = &CommitOptions{}
 	}
 
-	schema, err := FindSchema(handle, doc.Schema)
+	doc, err := FindDoc(handle, name)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	var paths []*path
-	paths, err = findSchemaPaths(handle, schema.id)
+	end, outOfOrder := now, false
+	if doc.UpdateTime.Valid && !now.After(doc.UpdateTime.Time) {
+		if !options.OutOfOrder {
+			return nil, fmt.Errorf("mon: commit time "+
+				"(`%s`) not after document (`%s`) "+
+				"last update time (`%s`)", now.String(),
+				name, doc.UpdateTime.Time.String())
+		}
+		end, outOfOrder = doc.UpdateTime.Time, true
+	}
+
+	schema, allPaths, err := findDocPathsAt(handle, doc, now, end)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	now := time.Now()
-	var lastSnapshot time.Time
-	if !snapshot {
-		lastSnapshot, err = findSnapshot(
-			handle, paths[0], doc, now)
+	// events of two commits at the same time would come in no order
+	if outOfOrder {
+		var taken bool
+		taken, err = hasCommitAt(handle, doc, allPaths, now)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		if taken {
+			return nil, fmt.Errorf("mon: commit time (`%s`) "+
+				"of document (`%s`) taken by another commit",
+				now.String(), name)
+		}
+	}
+
+	var later []laterCommit
+	if end.After(now) && !options.DryRun {
+		later, err = findLaterCommits(handle, doc, allPaths, now, end)
+		if err != nil {
+			return nil, err
 		}
 	}
 
+	var paths []*path
+	if paths, err = livePaths(schema, allPaths, now, now); err != nil {
+		return nil, err
+	}
+
+	// the state is computed (for changes) even for snapshots
+	snapshot := options.Snapshot
+	var lastSnapshot time.Time // zero if there's no history yet
+	last, err := findLastSnapshot(handle, paths[0], doc, now)
+	if err != nil {
+		return nil, err
+	}
+	if last.Valid {
+		lastSnapshot = last.Time
+		snapshot = snapshot || doc.isSnapshotDue(lastSnapshot, now)
+	} else if !snapshot {
+		return nil, noSnapshotError(doc, now)
+	}
+
 	var token interface{}
 	var elt xml.StartElement
 	decoder := xml.NewDecoder(reader)
@@ -54,23 +127,328 @@ L:
 	paths = filterPaths(paths, pathStr)
 	if len(paths) == 0 {
 		msg := "mon: element path (`%s`) not found"
-		return fmt.Errorf(msg, pathStr)
+		return nil, fmt.Errorf(msg, pathStr)
+	}
+
+	context := newCommitContext(
+		handle, schema.id, doc.id, snapshot, lastSnapshot, now)
+	context.decoder = decoder
+	context.dryRun = options.DryRun
+	context.latest = !options.DryRun && !outOfOrder
+	context.ignores, err = loadIgnoreRules(handle, schema.id)
+	if err != nil {
+		return nil, err
+	}
+	if context.bands, err = loadDeadbands(handle, schema.id); err != nil {
+		return nil, err
+	}
+	if !options.DryRun {
+		context.pending = &[]pendingEvent{}
+	}
+
+	attrs := context.ignores.filter(pathStr, elt.Attr)
+	err = commitPathTree(context, "", 0, paths, attrs)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = commitRemovals(context); err != nil {
+		return nil, err
+	}
+
+	if options.DryRun {
+		return context.changes, nil
+	}
+
+	// taken once the input is processed to keep the lock short
+	context.rev, err = addRevision(handle, doc, now, false)
+	if err != nil {
+		return nil, err
+	}
+	if err = insertPending(context); err != nil {
+		return nil, err
+	}
+
+	if len(later) != 0 {
+		err = replayCommits(handle, doc,
+			schema, allPaths, now, context.rev, later)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err = doc.Update(handle, end); err != nil {
+		return nil, err
+	}
+
+	if !end.After(now) { // in order
+		err = evaluateRules(handle, schema, doc, now, context.changes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return context.changes,
+		notifyCommit(handle, schema, doc, now, context.changes)
+}
+
+// whether the document has a commit (even with no events,
+// or an event of one made before the commits were registered)
+// at exactly the given time
+func hasCommitAt(handle data.Handle,
+	doc *Doc, paths []*path, at time.Time) (bool, error) {
+	times, err := findCommitTimes(handle, doc,
+		data.Eq{data.ColName{"", "time"}, at})
+	if err != nil || len(times) != 0 {
+		return len(times) != 0, err
+	}
+
+	for _, p := range paths {
+		rows, err := data.SelectRows(handle,
+			[]data.ColName{{"", "time"}},
+			[]data.Join{{"", "mon_path_" + fmt.Sprint(p.id), ""}},
+			data.And{data.Eq{data.ColName{"", "doc"}, doc.id},
+				data.Eq{data.ColName{"", "time"}, at}},
+			nil, nil, 1)
+		if err != nil {
+			return false, err
+		}
+
+		found := rows.Next()
+		if err = rows.Close(); err != nil || found {
+			return found, err
+		}
+	}
+
+	return false, nil
+}
+
+// full document state of a commit following an out of order one
+type laterCommit struct {
+	time     time.Time
+	snapshot bool
+	state    docState
+}
+
+// the document commit times matching the condition
+func findCommitTimes(handle data.Handle,
+	doc *Doc, where interface{}) ([]time.Time, error) {
+	rows, err := data.SelectRows(handle,
+		[]data.ColName{{"", "time"}},
+		[]data.Join{{"", "mon_commit", ""}},
+		data.And{data.Eq{data.ColName{"", "doc"}, doc.id}, where},
+		nil, []data.Order{{"", "time", false}}, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var times []time.Time
+	for rows.Next() {
+		var t time.Time
+		if err = rows.Scan(&t); err != nil {
+			return nil, err
+		}
+		times = append(times, t)
+	}
+
+	return times, rows.Err()
+}
+
+// Collects the commits within (from, to] and removes their events.
+// The registered commits are taken along with the ones having events
+// (e.g. made before the commits were registered or by compaction),
+// as the ones with no changes leave no events.
+func findLaterCommits(handle data.Handle, doc *Doc,
+	paths []*path, from, to time.Time) ([]laterCommit, error) {
+	times := []time.Time{to} // the last update
+	seen := map[time.Time]bool{to: true}
+	add := func(found []time.Time) {
+		for _, t := range found {
+			if !seen[t] {
+				seen[t] = true
+				times = append(times, t)
+			}
+		}
+	}
+
+	registered, err := findCommitTimes(handle, doc,
+		data.And{data.Gr{data.ColName{"", "time"}, from},
+			data.Ge{to, data.ColName{"", "time"}}})
+	if err != nil {
+		return nil, err
+	}
+	add(registered)
+
+	for _, p := range paths {
+		pathTimes, err := findEventTimes(
+			handle, p, doc, from, to, false)
+		if err != nil {
+			return nil, err
+		}
+		add(pathTimes)
+	}
+	sort.Sort(timeSlice(times))
+
+	snapshots, err := findEventTimes(handle, paths[0], doc, from, to, true)
+	if err != nil {
+		return nil, err
+	}
+	isSnapshot := make(map[time.Time]bool)
+	for _, t := range snapshots {
+		isSnapshot[t] = true
+	}
+
+	var commits []laterCommit
+	for _, t := range times {
+		state, err := computeDocState(handle, doc, paths, t)
+		if err != nil {
+			return nil, err
+		}
+		commits = append(commits, laterCommit{t, isSnapshot[t], state})
+	}
+
+	for _, p := range paths {
+		err = data.DeleteRows(handle, "mon_path_"+fmt.Sprint(p.id),
+			data.And{data.Eq{data.ColName{"", "doc"}, doc.id},
+				data.Gr{data.ColName{"", "time"}, from}})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return commits, nil
+}
+
+func computeDocState(handle data.Handle,
+	doc *Doc, paths []*path, at time.Time) (docState, error) {
+	lastSnapshot, err := findSnapshot(handle, paths[0], doc, at)
+	if err != nil {
+		return nil, err
+	}
+
+	state := make(docState)
+	for _, p := range paths {
+		state[p], err = computePathState(
+			handle, p, doc.id, lastSnapshot, at)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return state, nil
+}
+
+// Rewrites the later commits on top of the state at `from`
+// as a part of the given revision.
+func replayCommits(handle data.Handle, doc *Doc, schema *Schema,
+	paths []*path, from time.Time, rev int, later []laterCommit) error {
+	prev, err := computeDocState(handle, doc, paths, from)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range later {
+		context := newCommitContext(handle,
+			schema.id, doc.id, c.snapshot, from, c.time)
+		context.rev = rev
+		for p, pathState := range prev {
+			context.state[p] = pathState
+		}
+
+		for p, pathState := range c.state {
+			for parent, parentState := range pathState {
+				for monIdValue, e := range parentState {
+					err = commitPath(context, parent,
+						monIdValue, e.pos, p,
+						e.xmlAttrs(), e.value)
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		if err = commitRemovals(context); err != nil {
+			return err
+		}
+
+		prev, from = c.state, c.time
+	}
+
+	return nil
+}
+
+type timeSlice []time.Time
+
+func (times timeSlice) Len() int {
+	return len(times)
+}
+
+func (times timeSlice) Swap(i, j int) {
+	times[i], times[j] = times[j], times[i]
+}
+
+func (times timeSlice) Less(i, j int) bool {
+	return times[i].Before(times[j])
+}
+
+// Commits a snapshot of the current document state
+// (as it would be checked out now) without a new input.
+func ForceSnapshot(handle data.Handle, name string) error {
+	return data.Transact(handle, func(handle data.Handle) error {
+		return forceSnapshot(handle, name)
+	})
+}
+
+func forceSnapshot(handle data.Handle, name string) error {
+	now := time.Now()
+	doc, schema, paths, err := findDocPaths(handle, name, now, now)
+	if err != nil {
+		return err
 	}
 
-	context := commitContext{handle, decoder, schema.id,
-		doc.id, snapshot, lastSnapshot, now, make(docState)}
-	err = commitPathTree(&context, "", paths, elt.Attr)
+	var lastSnapshot time.Time
+	lastSnapshot, err = findSnapshot(handle, paths[0], doc, now)
 	if err != nil {
 		return err
 	}
 
-	if !snapshot {
-		if err = commitRemovals(&context); err != nil {
+	context := newCommitContext(
+		handle, schema.id, doc.id, true, lastSnapshot, now)
+	for _, p := range paths {
+		context.state[p], err = computePathState(
+			handle, p, doc.id, lastSnapshot, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	if context.rev, err = addRevision(handle, doc, now, true); err != nil {
+		return err
+	}
+	for _, p := range paths {
+		if err = addSnapshot(context, p); err != nil {
 			return err
 		}
 	}
 
-	return doc.Update(handle, context.now)
+	return doc.Update(handle, now)
+}
+
+// writes snapshot events for the path state kept in the context
+func addSnapshot(context *commitContext, path *path) error {
+	for parent, parentState := range context.state[path] {
+		for monIdValue, element := range parentState {
+			err := addEvent(context, path, snapshot,
+				parent, monIdValue, element.pos,
+				element.xmlAttrs(), element.value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 type commitContext struct {
@@ -82,6 +460,70 @@ type commitContext struct {
 	lastSnapshot time.Time
 	now          time.Time
 	state        docState
+	dryRun       bool
+	changes      []Change
+	ignores      ignoreRules     // none unless committing an input
+	bands        deadbands       // as well
+	rev          int             // zero if the events are out of the feed
+	latest       bool            // keeping the latest ignored values
+	pending      *[]pendingEvent // nil unless waiting for the revision
+}
+
+// an event to be inserted once the commit gets its revision
+type pendingEvent struct {
+	path    *path
+	columns map[string]interface{}
+}
+
+// inserts the pending events as a part of the context revision
+func insertPending(context *commitContext) error {
+	for _, e := range *context.pending {
+		hasRev, err := e.path.hasColumn(context.handle, "rev")
+		if err != nil {
+			return err
+		}
+		if hasRev {
+			e.columns["rev"] = context.rev
+		}
+
+		_, err = data.InsertRow(context.handle,
+			"mon_path_"+fmt.Sprint(e.path.id), e.columns, "")
+		if err != nil {
+			return err
+		}
+	}
+
+	context.pending = nil
+	return nil
+}
+
+// a context writing the events (out of the feed) as they are added
+func newCommitContext(handle data.Handle, schema, doc int,
+	snapshot bool, lastSnapshot, now time.Time) *commitContext {
+	return &commitContext{handle: handle, schema: schema, doc: doc,
+		snapshot: snapshot, lastSnapshot: lastSnapshot, now: now,
+		state: make(docState)}
+}
+
+func (context *commitContext) addChange(path *path, type_ int,
+	parent, monIdValue string, attrs []xml.Attr, value string) {
+	change := Change{context.now, type_,
+		path.path, parent, monIdValue, nil, nil, "", ""}
+
+	if type_ != ChangeAdded {
+		old := context.state[path][parent][monIdValue]
+		change.OldAttrs, change.OldValue = old.attrs, old.value
+	}
+
+	if type_ != ChangeRemoved {
+		change.NewAttrs = make(map[string]string)
+		for _, a := range attrs {
+			change.NewAttrs[a.Name.Local] = a.Value
+		}
+		change.NewValue = value
+	}
+
+	context.changes = append(context.changes, change)
 }
 
 func findAttr(attrs []xml.Attr, name string) *xml.Attr {
@@ -119,14 +561,16 @@ func getMonIdValue(context *commitContext,
 	return monIdValue, nil
 }
 
-func commitPathTree(context *commitContext,
-	parent string, paths []*path, attrs []xml.Attr) error {
+// pos is the element's position among its parent's children
+func commitPathTree(context *commitContext, parent string,
+	pos int, paths []*path, attrs []xml.Attr) error {
 	monIdValue, err := getMonIdValue(context, parent, paths, attrs)
 	if err != nil {
 		return err
 	}
 
 	var value string
+	var children int
 	for {
 		token, err := context.decoder.Token()
 		if err != nil {
@@ -137,17 +581,27 @@ func commitPathTree(context *commitContext,
 		case xml.StartElement:
 			elt := token.(xml.StartElement)
 			path := paths[0].path + "/" + elt.Name.Local
+			if context.ignores.skips(path) {
+				if err = context.decoder.Skip(); err != nil {
+					return err
+				}
+				children += 1
+				continue
+			}
+
 			paths2 := filterPaths(paths, path)
 			if len(paths2) == 0 {
 				msg := "mon: element path (`%s`) not found"
 				return fmt.Errorf(msg, path)
 			}
 
+			attrs2 := context.ignores.filter(path, elt.Attr)
 			err = commitPathTree(context,
-				monIdValue, paths2, elt.Attr)
+				monIdValue, children, paths2, attrs2)
 			if err != nil {
 				return err
 			}
+			children += 1
 		case xml.CharData:
 			data := string(token.(xml.CharData))
 			trimmed := strings.Trim(data, " \t\r\n")
@@ -163,8 +617,8 @@ func commitPathTree(context *commitContext,
 				}
 			}
 		case xml.EndElement:
-			return commitPath(context,
-				parent, monIdValue, paths[0], attrs, value)
+			return commitPath(context, parent,
+				monIdValue, pos, paths[0], attrs, value)
 		}
 	}
 
@@ -172,11 +626,19 @@ func commitPathTree(context *commitContext,
 }
 
 func commitPath(context *commitContext,
-	parent, monIdValue string, path *path,
+	parent, monIdValue string, pos int, path *path,
 	attrs []xml.Attr, value string) error {
-	var err error
+	// tables created before positions were recorded
+	hasPos, err := path.hasColumn(context.handle, "pos")
+	if err != nil {
+		return err
+	}
+	if !hasPos {
+		pos = -1
+	}
+
 	if _, ok := context.state[path]; !ok {
-		if context.snapshot {
+		if context.lastSnapshot.IsZero() {
 			context.state[path] = make(pathState)
 		} else {
 			context.state[path], err = computePathState(
@@ -193,41 +655,87 @@ func commitPath(context *commitContext,
 		pathState[parent] = make(parentState)
 	}
 
-	if context.snapshot {
-		return addEvent(context, path, snapshot,
-			parent, monIdValue, attrs, value)
-	}
+	event, type_ := addition, ChangeAdded
+	if element, ok := pathState[parent][monIdValue]; ok {
+		ignored := context.ignores[path.path]
+		bands := context.bands[path.path]
+		if !element.isChanged(attrs, value, ignored, bands) {
+			element.preserve = true
+			if context.snapshot {
+				return addEvent(context, path, snapshot,
+					parent, monIdValue, pos, attrs, value)
+			}
 
-	parentState := pathState[parent]
-	if _, ok := parentState[monIdValue]; !ok {
-		return addEvent(context, path, addition,
-			parent, monIdValue, attrs, value)
+			// a moved element gets a change event (not reported
+			// as a change) for checkouts to keep the sibling order
+			if pos >= 0 && pos != element.pos {
+				return addEvent(context, path, change,
+					parent, monIdValue, pos, attrs, value)
+			}
+			return keepLatest(context, path,
+				parent, monIdValue, element, attrs)
+		}
+		event, type_ = change, ChangeChanged
 	}
 
-	element := parentState[monIdValue]
-	if element.isChanged(attrs, value) {
-		return addEvent(context, path, change,
-			parent, monIdValue, attrs, value)
+	context.addChange(path, type_, parent, monIdValue, attrs, value)
+	if context.snapshot {
+		event = snapshot
 	}
-	context.state[path][parent][monIdValue].preserve = true
 
-	return nil
+	return addEvent(context, path, event,
+		parent, monIdValue, pos, attrs, value)
 }
 
-func addEvent(context *commitContext, path *path, event int, parent,
-	monIdValue string, attrs []xml.Attr, value string) error {
+// negative pos means the position is unknown
+func addEvent(context *commitContext, path *path, event int,
+	parent, monIdValue string, pos int,
+	attrs []xml.Attr, value string) error {
 	columns := map[string]interface{}{
 		"doc":   context.doc,
 		"time":  context.now,
 		"event": event,
 	}
 
+	// tables created before the markers were recorded
+	hasMarkers, err := path.hasColumn(context.handle, "empty")
+	if err != nil {
+		return err
+	}
+
 	if len(parent) != 0 {
 		columns["parent"] = parent
 	}
 
+	if context.rev != 0 {
+		var hasRev bool
+		hasRev, err = path.hasColumn(context.handle, "rev")
+		if err != nil {
+			return err
+		}
+		if hasRev {
+			columns["rev"] = context.rev
+		}
+	}
+
+	var empty []string
 	if len(value) != 0 {
 		columns["value"] = value
+	} else if hasMarkers && event != removal {
+		var hasValue bool
+		hasValue, err = path.hasColumn(context.handle, "value")
+		if err != nil {
+			return err
+		}
+		if hasValue {
+			empty = append(empty, "value")
+		}
+	}
+
+	valued := len(value) != 0 || len(empty) != 0
+
+	if pos >= 0 {
+		columns["pos"] = pos
 	}
 
 	// handy for removal
@@ -236,36 +744,65 @@ func addEvent(context *commitContext, path *path, event int, parent,
 	}
 
 	for _, a := range attrs {
-		columns["attr_"+a.Name.Local] = a.Value
+		if len(a.Value) == 0 && hasMarkers {
+			empty = append(empty, "attr_"+a.Name.Local)
+		} else {
+			columns["attr_"+a.Name.Local] = a.Value
+		}
 	}
 
-	_, err := data.InsertRow(context.handle,
-		"mon_path_"+fmt.Sprint(path.id), columns, "")
-	if err != nil {
-		return err
+	if len(empty) != 0 {
+		columns["empty"] = markerList(empty)
+	}
+
+	if context.pending != nil {
+		*context.pending = append(*context.pending,
+			pendingEvent{path, columns})
+	} else if !context.dryRun {
+		_, err = data.InsertRow(context.handle,
+			"mon_path_"+fmt.Sprint(path.id), columns, "")
+		if err != nil {
+			return err
+		}
+	}
+
+	if context.latest && context.ignores.keepsLatest(path.path) {
+		if err = clearLatest(context,
+			path, parent, monIdValue); err != nil {
+			return err
+		}
 	}
 
 	switch event {
-	case snapshot:
-		break
-	case addition:
+	case snapshot, addition, change:
 		attrs2 := map[string]string{}
 		for _, a := range attrs {
 			attrs2[a.Name.Local] = a.Value
 		}
-		context.state[path][parent][monIdValue] =
-			&element{attrs2, value, true}
-	case change, removal:
+		context.state[path][parent][monIdValue] = &element{attrs2,
+			value, valued, pos, context.now, true}
+	case removal:
 		context.state[path][parent][monIdValue].preserve = true
 	}
 
 	return nil
 }
 
+// marker columns list the names of the affected columns
+func markerList(columns []string) string {
+	sort.Strings(columns)
+	return strings.Join(columns, " ")
+}
+
 func commitRemovals(context *commitContext) error {
 	remove := func(path *path, parent, monIdValue string) error {
+		context.addChange(path,
+			ChangeRemoved, parent, monIdValue, nil, "")
+		if context.snapshot {
+			return nil // not in the snapshot anyway
+		}
 		return addEvent(context, path,
-			removal, parent, monIdValue, nil, "")
+			removal, parent, monIdValue, -1, nil, "")
 	}
 
 	for path, pathState := range context.state {
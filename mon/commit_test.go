@@ -0,0 +1,119 @@
+package mon
+
+import (
+	"btc/data"
+	"btc/xmls"
+	"bytes"
+	"database/sql"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSchema = `<xs:schema attributeFormDefault="unqualified"
+	elementFormDefault="qualified"
+	xmlns:xs="http://www.w3.org/2001/XMLSchema">
+  <xs:element name="etr">
+    <xs:complexType>
+      <xs:sequence>
+        <xs:element name="input" maxOccurs="unbounded"
+            minOccurs="0" monId="id">
+          <xs:complexType>
+            <xs:attribute type="xs:int" name="id"/>
+            <xs:attribute type="xs:string" name="state"/>
+          </xs:complexType>
+        </xs:element>
+      </xs:sequence>
+    </xs:complexType>
+  </xs:element>
+</xs:schema>`
+
+// a transaction (rolled back by the returned function) of a database
+// given by MON_TEST_DB connection string having document `etr1`
+func newTestHandle(t *testing.T) (*sql.Tx, func()) {
+	connStr := os.Getenv("MON_TEST_DB")
+	if len(connStr) == 0 {
+		t.Skip("MON_TEST_DB is not set")
+	}
+
+	db, err := data.Open(connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	done := func() {
+		tx.Rollback()
+		db.Close()
+	}
+
+	root, err := xmls.New(strings.NewReader(testSchema))
+	if err == nil {
+		err = Install(tx)
+	}
+	if err == nil {
+		err = AddSchema(tx, NewSchema("etr", ""), root)
+	}
+	if err == nil {
+		err = AddDoc(tx, NewDoc("etr1", "etr", "", 0, 0))
+	}
+	if err != nil {
+		done()
+		t.Fatal(err)
+	}
+
+	return tx, done
+}
+
+func TestCommitBeforeUnchangedCommits(t *testing.T) {
+	handle, done := newTestHandle(t)
+	defer done()
+
+	ok := `<etr><input id="1" state="ok"/></etr>`
+	failed := `<etr><input id="1" state="failed"/></etr>`
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	commit := func(doc string, minutes int,
+		options *CommitOptions) error {
+		_, err := CommitDocAt(handle, "etr1", strings.NewReader(doc),
+			start.Add(time.Duration(minutes)*time.Minute), options)
+		return err
+	}
+
+	backfill := &CommitOptions{false, true, false}
+	steps := []struct {
+		doc     string
+		minutes int
+		options *CommitOptions
+	}{
+		{ok, 0, &CommitOptions{true, false, false}},
+		{ok, 2, nil}, // no changes
+		{ok, 3, nil}, // no changes
+		{failed, 1, backfill},
+	}
+	for _, s := range steps {
+		if err := commit(s.doc, s.minutes, s.options); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for minutes, state := range []string{"ok", "failed", "ok", "ok"} {
+		var buf bytes.Buffer
+		at := start.Add(time.Duration(minutes) * time.Minute)
+		err := CheckoutDoc(handle, "etr1", at, &buf, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(buf.String(), `state="`+state+`"`) {
+			t.Errorf("minute %d: unexpected checkout %s",
+				minutes, buf.String())
+		}
+	}
+
+	if err := commit(failed, 2, backfill); err == nil {
+		t.Error("time of a commit with no changes reused")
+	}
+}
@@ -0,0 +1,120 @@
+package mon
+
+import (
+	"btc/data"
+	"fmt"
+	"time"
+)
+
+// Replaces the document history up to `before` inclusive with
+// a snapshot of the state at that moment, which must not be after
+// the document last update time. Checkouts of later moments are
+// not affected.
+func Compact(handle data.Handle, name string, before time.Time) error {
+	return data.Transact(handle, func(handle data.Handle) error {
+		return compact(handle, name, before)
+	})
+}
+
+func compact(handle data.Handle, name string, before time.Time) error {
+	doc, err := FindDoc(handle, name)
+	if err != nil {
+		return err
+	}
+
+	// a snapshot after the last commit would precede the next one
+	if !doc.UpdateTime.Valid || before.After(doc.UpdateTime.Time) {
+		return fmt.Errorf("mon: compaction time (`%s`) after "+
+			"document (`%s`) last update time",
+			before.String(), name)
+	}
+
+	schema, err := FindSchema(handle, doc.Schema)
+	if err != nil {
+		return err
+	}
+
+	var paths []*path
+	paths, err = findSchemaPaths(handle, schema.id)
+	if err != nil {
+		return err
+	}
+
+	var live []*path
+	if live, err = livePaths(schema, paths, before, before); err != nil {
+		return err
+	}
+
+	var lastSnapshot data.NullTime
+	lastSnapshot, err = findLastSnapshot(handle, live[0], doc, before)
+	if err != nil || !lastSnapshot.Valid {
+		return err // nothing to compact
+	}
+
+	context := newCommitContext(handle,
+		schema.id, doc.id, true, lastSnapshot.Time, before)
+	for _, p := range live {
+		context.state[p], err = computePathState(handle,
+			p, doc.id, lastSnapshot.Time, before)
+		if err != nil {
+			return err
+		}
+	}
+
+	// paths dropped by then have nothing to keep
+	for _, p := range paths {
+		err = data.DeleteRows(handle, "mon_path_"+fmt.Sprint(p.id),
+			data.And{data.Eq{data.ColName{"", "doc"}, doc.id},
+				data.Ge{before, data.ColName{"", "time"}}})
+		if err != nil {
+			return err
+		}
+
+		if _, ok := context.state[p]; ok {
+			if err = addSnapshot(context, p); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Sets the period (in seconds) of history kept by Prune.
+func SetRetainPeriod(handle data.Handle, name string, period int) error {
+	doc, err := FindDoc(handle, name)
+	if err != nil {
+		return err
+	}
+
+	return data.UpdateRows(handle, "mon_doc",
+		map[string]interface{}{"rperiod": period},
+		data.Eq{data.ColName{"", "id"}, doc.id})
+}
+
+// Compacts the history of every document having a retain period
+// to that period (but not beyond the document last update time).
+func Prune(handle data.Handle) error {
+	docs, err := findDocs(handle, nil)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, d := range docs {
+		if d.RetainPeriod <= 0 || !d.UpdateTime.Valid {
+			continue
+		}
+
+		period := time.Duration(d.RetainPeriod) * time.Second
+		before := now.Add(-period)
+		if before.After(d.UpdateTime.Time) {
+			before = d.UpdateTime.Time
+		}
+		if err = Compact(handle, d.Name, before); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
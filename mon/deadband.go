@@ -0,0 +1,220 @@
+package mon
+
+import (
+	"btc/data"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const ( // deadband types
+	DeadbandAbsolute = iota
+	DeadbandPercent  = iota
+)
+
+// Suppresses changes of an integer attribute (or value) of the element
+// path which don't exceed the amount (or the amount percent of the last
+// recorded value). Real shifts are recorded, so the stored value never
+// drifts from the actual one by more than the deadband.
+type Deadband struct {
+	Path   string
+	Attr   string // empty for the element value
+	Amount int
+	Type   int // DeadbandAbsolute or DeadbandPercent
+}
+
+func (band *Deadband) column() string {
+	if len(band.Attr) == 0 {
+		return "value"
+	}
+	return "attr_" + band.Attr
+}
+
+func (band *Deadband) suppresses(old, new_ string) bool {
+	o, err := strconv.ParseInt(old, 10, 64)
+	if err != nil {
+		return false
+	}
+	n, err := strconv.ParseInt(new_, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	delta := n - o
+	if delta < 0 {
+		delta = -delta
+	}
+	if band.Type == DeadbandAbsolute {
+		return delta <= int64(band.Amount)
+	}
+
+	if o < 0 {
+		o = -o
+	}
+	return delta*100 <= o*int64(band.Amount)
+}
+
+// Sets the deadband, replacing the one for the same field if any.
+func SetDeadband(handle data.Handle,
+	schemaName string, band *Deadband) error {
+	return data.Transact(handle, func(handle data.Handle) error {
+		return setDeadband(handle, schemaName, band)
+	})
+}
+
+func setDeadband(handle data.Handle,
+	schemaName string, band *Deadband) error {
+	schema, err := FindSchema(handle, schemaName)
+	if err != nil {
+		return err
+	}
+
+	if err = checkDeadband(handle, schema, band); err != nil {
+		return err
+	}
+
+	if err = removeDeadband(handle,
+		schema, band.Path, band.Attr); err != nil {
+		return err
+	}
+
+	columns := map[string]interface{}{
+		"schema": schema.id,
+		"path":   band.Path,
+		"attr":   band.Attr,
+		"amount": band.Amount,
+		"type":   band.Type,
+	}
+	_, err = data.InsertRow(handle, "mon_deadband", columns, "id")
+	return err
+}
+
+func checkDeadband(handle data.Handle,
+	schema *Schema, band *Deadband) error {
+	if band.Type != DeadbandAbsolute &&
+		band.Type != DeadbandPercent {
+		return fmt.Errorf("mon: unknown deadband "+
+			"type (`%d`)", band.Type)
+	}
+	if band.Amount < 0 {
+		return fmt.Errorf("mon: negative deadband "+
+			"amount (`%d`)", band.Amount)
+	}
+
+	paths, err := findSchemaPaths(handle, schema.id)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if paths, err = livePaths(schema, paths, now, now); err != nil {
+		return err
+	}
+
+	var path *path
+	for _, p := range paths {
+		if p.path == band.Path {
+			path = p
+		}
+	}
+	if path == nil {
+		return fmt.Errorf("mon: element path (`%s`) not found "+
+			"for schema (`%s`)", band.Path, schema.Name)
+	}
+
+	if len(band.Attr) != 0 && band.Attr == path.monId.String {
+		return fmt.Errorf("mon: no deadband allowed for "+
+			"`monId` attribute (`%s`)", band.Attr)
+	}
+
+	type_, err := path.columnType(handle, band.column())
+	if err != nil {
+		return err
+	}
+	if len(type_) == 0 {
+		return fmt.Errorf("mon: no field (`%s`) for "+
+			"element path (`%s`)", band.column(), path.path)
+	}
+	if data.ColumnTypeOf(type_) != data.Integer {
+		return fmt.Errorf("mon: field (`%s`) for element "+
+			"path (`%s`) is not numeric", band.column(), path.path)
+	}
+
+	return nil
+}
+
+func RemoveDeadband(handle data.Handle,
+	schemaName, path, attr string) error {
+	schema, err := FindSchema(handle, schemaName)
+	if err != nil {
+		return err
+	}
+
+	return removeDeadband(handle, schema, path, attr)
+}
+
+func removeDeadband(handle data.Handle,
+	schema *Schema, path, attr string) error {
+	return data.DeleteRows(handle, "mon_deadband",
+		data.And{data.Eq{data.ColName{"", "schema"}, schema.id},
+			data.And{data.Eq{data.ColName{"", "path"}, path},
+				data.Eq{data.ColName{"", "attr"}, attr}}})
+}
+
+func Deadbands(handle data.Handle,
+	schemaName string) ([]Deadband, error) {
+	schema, err := FindSchema(handle, schemaName)
+	if err != nil {
+		return nil, err
+	}
+
+	return findDeadbands(handle, schema.id)
+}
+
+func findDeadbands(
+	handle data.Handle, schemaId int) ([]Deadband, error) {
+	rows, err := data.SelectRows(handle,
+		[]data.ColName{{"", "path"}, {"", "attr"},
+			{"", "amount"}, {"", "type"}},
+		[]data.Join{{"", "mon_deadband", ""}},
+		data.Eq{data.ColName{"", "schema"}, schemaId},
+		nil, []data.Order{{"", "path", false},
+			{"", "attr", false}}, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bands []Deadband
+	for rows.Next() {
+		var band Deadband
+		if err = rows.Scan(&band.Path, &band.Attr,
+			&band.Amount, &band.Type); err != nil {
+			return nil, err
+		}
+		bands = append(bands, band)
+	}
+
+	return bands, rows.Err()
+}
+
+// element path => attribute name (empty for value) => deadband
+type deadbands map[string]map[string]*Deadband
+
+func loadDeadbands(handle data.Handle, schemaId int) (deadbands, error) {
+	list, err := findDeadbands(handle, schemaId)
+	if err != nil {
+		return nil, err
+	}
+
+	bands := make(deadbands)
+	for i := range list {
+		b := &list[i]
+		if _, ok := bands[b.Path]; !ok {
+			bands[b.Path] = make(map[string]*Deadband)
+		}
+		bands[b.Path][b.Attr] = b
+	}
+
+	return bands, nil
+}
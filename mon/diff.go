@@ -0,0 +1,331 @@
+package mon
+
+import (
+	"btc/data"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"sort"
+	"time"
+)
+
+const ( // change types
+	ChangeAdded    = iota
+	ChangeChanged  = iota
+	ChangeRemoved  = iota
+	ChangeSnapshot = iota // full element state (only in the change feed)
+)
+
+var changeTypeNames = []string{"added", "changed", "removed", "snapshot"}
+
+type Change struct {
+	Time     time.Time
+	Type     int
+	Path     string
+	Parent   string // parent's monId value
+	MonId    string // element's monId value
+	OldAttrs map[string]string
+	NewAttrs map[string]string
+	OldValue string
+	NewValue string
+}
+
+// Returns the changes committed after `from` and up to `to` inclusive
+// (`from` may precede the document creation).
+func DiffDoc(handle data.Handle,
+	name string, from, to time.Time) ([]Change, error) {
+	doc, _, paths, err := findDocPaths(
+		handle, name, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastSnapshot data.NullTime
+	lastSnapshot, err = findLastSnapshot(handle, paths[0], doc, from)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []time.Time
+	snapshots, err = findEventTimes(
+		handle, paths[0], doc, from, to, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []Change
+	for _, p := range paths {
+		state, err := computePathStateSince(
+			handle, p, doc.id, lastSnapshot, from)
+		if err != nil {
+			return nil, err
+		}
+
+		pathChanges, err := diffPath(
+			handle, p, doc, state, from, to, snapshots)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, pathChanges...)
+	}
+
+	sort.Stable(changesByTime(changes))
+	return changes, nil
+}
+
+type changesByTime []Change
+
+func (changes changesByTime) Len() int {
+	return len(changes)
+}
+
+func (changes changesByTime) Swap(i, j int) {
+	changes[i], changes[j] = changes[j], changes[i]
+}
+
+// simultaneous changes are ordered by path, parent and monId value
+func (changes changesByTime) Less(i, j int) bool {
+	a, b := &changes[i], &changes[j]
+	switch {
+	case !a.Time.Equal(b.Time):
+		return a.Time.Before(b.Time)
+	case a.Path != b.Path:
+		return a.Path < b.Path
+	case a.Parent != b.Parent:
+		return a.Parent < b.Parent
+	default:
+		return a.MonId < b.MonId
+	}
+}
+
+// advances the path state at `from` (modifying it) up to `to`
+func diffPath(handle data.Handle, path *path, doc *Doc,
+	state pathState, from, to time.Time,
+	snapshots []time.Time) ([]Change, error) {
+	events, err := findPathEvents(
+		handle, path.id, doc.id, from, to, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []Change
+	diff := func(time_ time.Time,
+		parent, monIdVal string, old, new_ *element) {
+		if old != nil && new_ != nil && old.equals(new_) {
+			return // position change only
+		}
+
+		change := Change{time_, ChangeChanged,
+			path.path, parent, monIdVal, nil, nil, "", ""}
+		if old == nil {
+			change.Type = ChangeAdded
+		} else {
+			change.OldAttrs = old.attrs
+			change.OldValue = old.value
+		}
+		if new_ == nil {
+			change.Type = ChangeRemoved
+		} else {
+			change.NewAttrs = new_.attrs
+			change.NewValue = new_.value
+		}
+		changes = append(changes, change)
+	}
+
+	monIdValue := func(e *event) string {
+		if path.monId.Valid {
+			return e.attrs[path.monId.String]
+		}
+		return ""
+	}
+
+	apply := func(e *event) {
+		monIdVal := monIdValue(e)
+		if _, ok := state[e.parent]; !ok {
+			state[e.parent] = make(parentState)
+		}
+
+		old := state[e.parent][monIdVal]
+		if e.event == removal {
+			if old != nil {
+				diff(e.time, e.parent, monIdVal, old, nil)
+			}
+			delete(state[e.parent], monIdVal)
+			return
+		}
+
+		new_ := &element{e.attrs,
+			e.value, e.valued, e.pos, e.time, false}
+		diff(e.time, e.parent, monIdVal, old, new_)
+		state[e.parent][monIdVal] = new_
+	}
+
+	k := 0
+	for k < len(events) && !events[k].time.After(from) {
+		k += 1
+	}
+
+	// a snapshot replaces the whole state, even if it's empty
+	for _, s := range snapshots {
+		for ; k < len(events) && events[k].time.Before(s); k += 1 {
+			apply(&events[k])
+		}
+
+		state2 := make(pathState)
+		for ; k < len(events) && events[k].time.Equal(s) &&
+			events[k].event == snapshot; k += 1 {
+			e := &events[k]
+			if _, ok := state2[e.parent]; !ok {
+				state2[e.parent] = make(parentState)
+			}
+			state2[e.parent][monIdValue(e)] = &element{e.attrs,
+				e.value, e.valued, e.pos, e.time, false}
+		}
+
+		for parent, parentState := range state {
+			for monIdVal, old := range parentState {
+				diff(s, parent, monIdVal,
+					old, state2[parent][monIdVal])
+			}
+		}
+		for parent, parentState := range state2 {
+			for monIdVal, new_ := range parentState {
+				if state[parent][monIdVal] == nil {
+					diff(s, parent, monIdVal, nil, new_)
+				}
+			}
+		}
+
+		state = state2
+	}
+
+	for ; k < len(events); k += 1 {
+		apply(&events[k])
+	}
+
+	sort.Stable(changesByTime(changes))
+	return changes, nil
+}
+
+func WriteDiffXML(writer io.Writer,
+	changes []Change, prefix, indent string) error {
+	encoder := xml.NewEncoder(writer)
+	encoder.Indent(prefix, indent)
+
+	name := func(local string) xml.Name {
+		return xml.Name{"", local}
+	}
+
+	encodeState := func(local string,
+		attrs map[string]string, value string) error {
+		if attrs == nil {
+			return nil
+		}
+
+		start := xml.StartElement{name(local), nil}
+		if err := encoder.EncodeToken(start); err != nil {
+			return err
+		}
+
+		for _, n := range sortedAttrNames(attrs) {
+			attr := xml.StartElement{name("attr"), []xml.Attr{
+				{name("name"), n}, {name("value"), attrs[n]}}}
+			if err := encoder.EncodeToken(attr); err != nil {
+				return err
+			}
+			err := encoder.EncodeToken(attr.End())
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(value) != 0 {
+			val := xml.StartElement{name("value"), nil}
+			if err := encoder.EncodeToken(val); err != nil {
+				return err
+			}
+			err := encoder.EncodeToken(xml.CharData(value))
+			if err != nil {
+				return err
+			}
+			if err = encoder.EncodeToken(val.End()); err != nil {
+				return err
+			}
+		}
+
+		return encoder.EncodeToken(start.End())
+	}
+
+	diff := xml.StartElement{name("diff"), nil}
+	if err := encoder.EncodeToken(diff); err != nil {
+		return err
+	}
+
+	for _, c := range changes {
+		start := xml.StartElement{name("change"), []xml.Attr{
+			{name("time"), c.Time.Format(time.RFC3339Nano)},
+			{name("type"), changeTypeNames[c.Type]},
+			{name("path"), c.Path}}}
+		if len(c.Parent) != 0 {
+			start.Attr = append(start.Attr,
+				xml.Attr{name("parent"), c.Parent})
+		}
+		if len(c.MonId) != 0 {
+			start.Attr = append(start.Attr,
+				xml.Attr{name("monId"), c.MonId})
+		}
+
+		if err := encoder.EncodeToken(start); err != nil {
+			return err
+		}
+		err := encodeState("old", c.OldAttrs, c.OldValue)
+		if err != nil {
+			return err
+		}
+		err = encodeState("new", c.NewAttrs, c.NewValue)
+		if err != nil {
+			return err
+		}
+		if err = encoder.EncodeToken(start.End()); err != nil {
+			return err
+		}
+	}
+
+	if err := encoder.EncodeToken(diff.End()); err != nil {
+		return err
+	}
+
+	return encoder.Flush()
+}
+
+type jsonState struct {
+	Attrs map[string]string `json:"attrs"`
+	Value string            `json:"value,omitempty"`
+}
+
+type jsonChange struct {
+	Time   time.Time  `json:"time"`
+	Type   string     `json:"type"`
+	Path   string     `json:"path"`
+	Parent string     `json:"parent,omitempty"`
+	MonId  string     `json:"monId,omitempty"`
+	Old    *jsonState `json:"old,omitempty"`
+	New    *jsonState `json:"new,omitempty"`
+}
+
+func WriteDiffJSON(writer io.Writer, changes []Change) error {
+	jsonChanges := []jsonChange{}
+	for _, c := range changes {
+		change := jsonChange{c.Time, changeTypeNames[c.Type],
+			c.Path, c.Parent, c.MonId, nil, nil}
+		if c.OldAttrs != nil {
+			change.Old = &jsonState{c.OldAttrs, c.OldValue}
+		}
+		if c.NewAttrs != nil {
+			change.New = &jsonState{c.NewAttrs, c.NewValue}
+		}
+		jsonChanges = append(jsonChanges, change)
+	}
+
+	return json.NewEncoder(writer).Encode(jsonChanges)
+}
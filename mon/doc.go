@@ -14,12 +14,13 @@ type Doc struct {
 	UpdatePeriod   int
 	SnapshotPeriod int
 	UpdateTime     data.NullTime
+	RetainPeriod   int // history kept for Prune (forever if zero)
 }
 
 func NewDoc(name, schema, url string,
 	updatePeriod, snapshotPeriod int) *Doc {
 	return &Doc{0, name, schema, url,
-		updatePeriod, snapshotPeriod, data.TimeAsNull()}
+		updatePeriod, snapshotPeriod, data.TimeAsNull(), 0}
 }
 
 func AddDoc(handle data.Handle, doc *Doc) error {
@@ -35,42 +36,102 @@ func AddDoc(handle data.Handle, doc *Doc) error {
 		"uperiod": doc.UpdatePeriod,
 		"speriod": doc.SnapshotPeriod,
 		"utime":   doc.UpdateTime,
+		"rperiod": doc.RetainPeriod,
 	}
 	doc.id, err = data.InsertRow(handle, "mon_doc", columns, "id")
 
 	return err
 }
 
-func FindDoc(handle data.Handle, name string) (*Doc, error) {
+func findDocs(handle data.Handle, where interface{}) ([]*Doc, error) {
 	rows, err := data.SelectRows(handle,
 		[]data.ColName{
 			{"mon_doc", "id"},
+			{"mon_doc", "name"},
 			{"mon_schema", "name"},
 			{"", "url"},
 			{"", "uperiod"},
 			{"", "speriod"},
-			{"", "utime"}},
+			{"", "utime"},
+			{"", "rperiod"}},
 		[]data.Join{
 			{"", "mon_doc", "schema"},
 			{"id", "mon_schema", ""}},
-		data.Eq{data.ColName{"mon_doc", "name"}, name}, nil, nil, -1)
+		where, nil, []data.Order{{"mon_doc", "name", false}}, -1)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	if !rows.Next() {
-		return nil, fmt.Errorf("mon: document (`%s`) not found", name)
+	var docs []*Doc
+	for rows.Next() {
+		var doc Doc
+		if err = rows.Scan(&doc.id, &doc.Name, &doc.Schema,
+			&doc.Url, &doc.UpdatePeriod, &doc.SnapshotPeriod,
+			&doc.UpdateTime, &doc.RetainPeriod); err != nil {
+			return nil, err
+		}
+		docs = append(docs, &doc)
 	}
 
-	var doc Doc
-	doc.Name = name
-	if err = rows.Scan(&doc.id, &doc.Schema, &doc.Url, &doc.UpdatePeriod,
-		&doc.SnapshotPeriod, &doc.UpdateTime); err != nil {
+	return docs, rows.Err()
+}
+
+func FindDoc(handle data.Handle, name string) (*Doc, error) {
+	docs, err := findDocs(handle,
+		data.Eq{data.ColName{"mon_doc", "name"}, name})
+	if err != nil {
 		return nil, err
 	}
 
-	return &doc, nil
+	if len(docs) == 0 {
+		return nil, fmt.Errorf("mon: document (`%s`) not found", name)
+	}
+
+	return docs[0], nil
+}
+
+// whether the last snapshot is older than the snapshot period
+func (doc *Doc) isSnapshotDue(lastSnapshot, now time.Time) bool {
+	period := time.Duration(doc.SnapshotPeriod) * time.Second
+	return doc.SnapshotPeriod > 0 && !now.Before(lastSnapshot.Add(period))
+}
+
+// Lists documents (of the given schema unless it's empty), optionally
+// only those not updated within their update periods.
+func ListDocs(handle data.Handle,
+	schema string, staleOnly bool) ([]*Doc, error) {
+	var where interface{}
+	if len(schema) != 0 {
+		where = data.Eq{data.ColName{"mon_schema", "name"}, schema}
+	}
+
+	docs, err := findDocs(handle, where)
+	if err != nil || !staleOnly {
+		return docs, err
+	}
+
+	now := time.Now()
+	var stale []*Doc
+	for _, d := range docs {
+		if d.IsStale(now) {
+			stale = append(stale, d)
+		}
+	}
+
+	return stale, nil
+}
+
+// whether the document hasn't been updated within its update period
+// (never true for the documents without one, which aren't polled)
+func (doc *Doc) IsStale(now time.Time) bool {
+	if doc.UpdatePeriod <= 0 {
+		return false
+	}
+
+	period := time.Duration(doc.UpdatePeriod) * time.Second
+	return !doc.UpdateTime.Valid ||
+		now.After(doc.UpdateTime.Time.Add(period))
 }
 
 func (doc *Doc) Update(handle data.Handle, updateTime time.Time) error {
@@ -0,0 +1,158 @@
+package mon
+
+import (
+	"btc/data"
+	"sort"
+	"time"
+)
+
+// Revision of the last consumed commit, zero to start from scratch.
+type Cursor int
+
+type FeedEntry struct {
+	Cursor Cursor // the entry's commit revision
+	Doc    string
+	Change Change // OldAttrs and OldValue are not set
+}
+
+// registers a commit of the document (forced if it's made by
+// ForceSnapshot), revisions are assigned (and become visible) in the
+// order of the commit transactions, so it's called once the commit
+// is ready to write its events
+func addRevision(handle data.Handle,
+	doc *Doc, at time.Time, forced bool) (int, error) {
+	if err := data.LockTable(handle, "mon_commit"); err != nil {
+		return 0, err
+	}
+
+	columns := map[string]interface{}{
+		"doc":    doc.id,
+		"time":   at,
+		"ctime":  time.Now(),
+		"forced": 0,
+	}
+	if forced {
+		columns["forced"] = 1
+	}
+	return data.InsertRow(handle, "mon_commit", columns, "id")
+}
+
+// Returns the events of up to `limit` commits made after the cursor
+// one (across all the documents) along with the cursor to resume
+// from. Snapshot commits are represented by ChangeSnapshot entries
+// holding the full state, while out of order ones also include the
+// rewritten events of the later commits. Elements moved among their
+// siblings are represented by ChangeChanged entries too.
+func Changes(handle data.Handle,
+	since Cursor, limit int) ([]FeedEntry, Cursor, error) {
+	rows, err := data.SelectRows(handle,
+		[]data.ColName{{"mon_commit", "id"}, {"mon_doc", "name"},
+			{"mon_doc", "schema"}},
+		[]data.Join{{"", "mon_commit", "doc"}, {"id", "mon_doc", ""}},
+		data.Gr{data.ColName{"mon_commit", "id"}, int(since)},
+		nil, []data.Order{{"mon_commit", "id", false}}, limit)
+	if err != nil {
+		return nil, since, err
+	}
+	defer rows.Close()
+
+	names := make(map[int]string)
+	var schemas []int
+	seen := make(map[int]bool)
+	last := since
+	for rows.Next() {
+		var rev, schema int
+		var name string
+		if err = rows.Scan(&rev, &name, &schema); err != nil {
+			return nil, since, err
+		}
+		names[rev] = name
+		if !seen[schema] {
+			seen[schema] = true
+			schemas = append(schemas, schema)
+		}
+		last = Cursor(rev)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, since, err
+	}
+
+	where := data.And{data.Gr{data.ColName{"", "rev"}, int(since)},
+		data.Ge{int(last), data.ColName{"", "rev"}}}
+	var entries []FeedEntry
+	for _, s := range schemas {
+		var paths []*path
+		if paths, err = findSchemaPaths(handle, s); err != nil {
+			return nil, since, err
+		}
+
+		for _, p := range paths {
+			var hasRev bool
+			hasRev, err = p.hasColumn(handle, "rev")
+			if err != nil {
+				return nil, since, err
+			}
+			if !hasRev {
+				continue
+			}
+
+			var events []event
+			events, err = selectPathEvents(handle, p.id, where)
+			if err != nil {
+				return nil, since, err
+			}
+
+			for i := range events {
+				entries = append(entries,
+					feedEntry(p, names, &events[i]))
+			}
+		}
+	}
+
+	sort.Stable(feedEntries(entries))
+	return entries, last, nil
+}
+
+func feedEntry(path *path, names map[int]string, e *event) FeedEntry {
+	change_ := Change{e.time, ChangeAdded,
+		path.path, e.parent, "", nil, nil, "", ""}
+	if path.monId.Valid {
+		change_.MonId = e.attrs[path.monId.String]
+	}
+
+	switch e.event {
+	case snapshot:
+		change_.Type = ChangeSnapshot
+	case change:
+		change_.Type = ChangeChanged
+	case removal:
+		change_.Type = ChangeRemoved
+	}
+	if e.event != removal {
+		change_.NewAttrs, change_.NewValue = e.attrs, e.value
+	}
+
+	return FeedEntry{Cursor(e.rev), names[e.rev], change_}
+}
+
+// Orders entries by revision, then by time and path.
+type feedEntries []FeedEntry
+
+func (entries feedEntries) Len() int {
+	return len(entries)
+}
+
+func (entries feedEntries) Swap(i, j int) {
+	entries[i], entries[j] = entries[j], entries[i]
+}
+
+func (entries feedEntries) Less(i, j int) bool {
+	a, b := &entries[i], &entries[j]
+	if a.Cursor != b.Cursor {
+		return a.Cursor < b.Cursor
+	}
+	if !a.Change.Time.Equal(b.Change.Time) {
+		return a.Change.Time.Before(b.Change.Time)
+	}
+	return a.Change.Path < b.Change.Path
+}
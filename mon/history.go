@@ -0,0 +1,116 @@
+package mon
+
+import (
+	"btc/data"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type ElementState struct {
+	Time    time.Time
+	Present bool // false if the element has been removed
+	Attrs   map[string]string
+	Value   string
+}
+
+// Returns the states of a single element within [from, to] starting
+// with the one in effect at `from` (if the element existed by then).
+// The element is identified by its schema path and the monId values
+// of the path's elements having `monId` (from the root downwards).
+func ElementHistory(handle data.Handle, name, pathStr string,
+	monIds []string, from, to time.Time) ([]ElementState, error) {
+	doc, _, paths, err := findDocPaths(
+		handle, name, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	path, parent, monIdVal, err := resolveElement(paths, pathStr, monIds)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastSnapshot data.NullTime
+	lastSnapshot, err = findLastSnapshot(handle, paths[0], doc, from)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []time.Time
+	snapshots, err = findEventTimes(
+		handle, paths[0], doc, from, to, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var state pathState
+	state, err = computePathStateSince(
+		handle, path, doc.id, lastSnapshot, from)
+	if err != nil {
+		return nil, err
+	}
+
+	var history []ElementState
+	if element := state[parent][monIdVal]; element != nil {
+		history = append(history, ElementState{
+			from, true, element.attrs, element.value})
+	}
+
+	var changes []Change
+	changes, err = diffPath(
+		handle, path, doc, state, from, to, snapshots)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range changes {
+		if c.Parent == parent && c.MonId == monIdVal {
+			history = append(history,
+				ElementState{c.Time, c.Type != ChangeRemoved,
+					c.NewAttrs, c.NewValue})
+		}
+	}
+
+	return history, nil
+}
+
+// Finds the element path with the (stored) monId values
+// of the element's parent and the element itself.
+func resolveElement(paths []*path, pathStr string,
+	monIds []string) (*path, string, string, error) {
+	var chain []*path // from the root down to the element
+	count := 0
+	for _, p := range paths {
+		if p.path == pathStr || strings.HasPrefix(pathStr, p.path+"/") {
+			chain = append(chain, p)
+			if p.monId.Valid {
+				count += 1
+			}
+		}
+	}
+
+	if len(chain) == 0 || chain[len(chain)-1].path != pathStr {
+		return nil, "", "", fmt.Errorf(
+			"mon: element path (`%s`) not found", pathStr)
+	}
+
+	if count != len(monIds) {
+		return nil, "", "", fmt.Errorf("mon: monId chain (`%s`) "+
+			"doesn't match element path (`%s`)",
+			strings.Join(monIds, "/"), pathStr)
+	}
+
+	i := 0
+	var parent, monIdVal string
+	for _, p := range chain {
+		var value string
+		if p.monId.Valid {
+			value = monIds[i]
+			i += 1
+		}
+		parent, monIdVal = monIdVal, value
+	}
+
+	return chain[len(chain)-1], parent, monIdVal, nil
+}
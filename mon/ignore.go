@@ -0,0 +1,337 @@
+package mon
+
+import (
+	"btc/data"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const ( // ignore modes
+	IgnoreDrop   = iota // store nothing
+	IgnoreLatest = iota // store only the latest value
+)
+
+// Makes commits disregard a volatile attribute of the element path
+// or (if the attribute is empty) the whole path subtree. With
+// IgnoreLatest the attribute is stored, but its changes alone are
+// not recorded: only its latest value is kept (see LatestValues).
+type IgnoreRule struct {
+	Path string
+	Attr string // empty for the path subtree (IgnoreDrop only)
+	Mode int
+}
+
+// Adds the rule, replacing the one for the same field if any.
+func AddIgnoreRule(handle data.Handle,
+	schemaName string, rule *IgnoreRule) error {
+	return data.Transact(handle, func(handle data.Handle) error {
+		return addIgnoreRule(handle, schemaName, rule)
+	})
+}
+
+func addIgnoreRule(handle data.Handle,
+	schemaName string, rule *IgnoreRule) error {
+	schema, err := FindSchema(handle, schemaName)
+	if err != nil {
+		return err
+	}
+
+	if err = checkIgnoreRule(handle, schema, rule); err != nil {
+		return err
+	}
+
+	if err = removeIgnoreRule(handle,
+		schema, rule.Path, rule.Attr); err != nil {
+		return err
+	}
+
+	columns := map[string]interface{}{
+		"schema": schema.id,
+		"path":   rule.Path,
+		"attr":   rule.Attr,
+		"mode":   rule.Mode,
+	}
+	_, err = data.InsertRow(handle, "mon_ignore", columns, "id")
+	return err
+}
+
+func checkIgnoreRule(handle data.Handle,
+	schema *Schema, rule *IgnoreRule) error {
+	if rule.Mode != IgnoreDrop && rule.Mode != IgnoreLatest {
+		return fmt.Errorf("mon: unknown ignore mode (`%d`)", rule.Mode)
+	}
+
+	paths, err := findSchemaPaths(handle, schema.id)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if paths, err = livePaths(schema, paths, now, now); err != nil {
+		return err
+	}
+
+	var path *path
+	for _, p := range paths {
+		if p.path == rule.Path {
+			path = p
+		}
+	}
+	if path == nil {
+		return fmt.Errorf("mon: element path (`%s`) not found "+
+			"for schema (`%s`)", rule.Path, schema.Name)
+	}
+
+	if len(rule.Attr) == 0 {
+		if strings.Count(path.path, "/") == 1 {
+			return fmt.Errorf("mon: root element path "+
+				"(`%s`) can't be ignored", path.path)
+		}
+		if rule.Mode != IgnoreDrop {
+			return fmt.Errorf("mon: only latest attribute "+
+				"values can be kept, not of path (`%s`)",
+				path.path)
+		}
+		return nil
+	}
+
+	if rule.Attr == path.monId.String {
+		return fmt.Errorf("mon: `monId` attribute (`%s`) "+
+			"can't be ignored", rule.Attr)
+	}
+
+	ok, err := path.hasColumn(handle, "attr_"+rule.Attr)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("mon: attribute (`%s`) not found "+
+			"for element path (`%s`)", rule.Attr, path.path)
+	}
+
+	return nil
+}
+
+func RemoveIgnoreRule(handle data.Handle,
+	schemaName, path, attr string) error {
+	schema, err := FindSchema(handle, schemaName)
+	if err != nil {
+		return err
+	}
+
+	return removeIgnoreRule(handle, schema, path, attr)
+}
+
+func removeIgnoreRule(handle data.Handle,
+	schema *Schema, path, attr string) error {
+	return data.DeleteRows(handle, "mon_ignore",
+		data.And{data.Eq{data.ColName{"", "schema"}, schema.id},
+			data.And{data.Eq{data.ColName{"", "path"}, path},
+				data.Eq{data.ColName{"", "attr"}, attr}}})
+}
+
+func IgnoreRules(handle data.Handle,
+	schemaName string) ([]IgnoreRule, error) {
+	schema, err := FindSchema(handle, schemaName)
+	if err != nil {
+		return nil, err
+	}
+
+	return findIgnoreRules(handle, schema.id)
+}
+
+func findIgnoreRules(
+	handle data.Handle, schemaId int) ([]IgnoreRule, error) {
+	rows, err := data.SelectRows(handle,
+		[]data.ColName{{"", "path"}, {"", "attr"}, {"", "mode"}},
+		[]data.Join{{"", "mon_ignore", ""}},
+		data.Eq{data.ColName{"", "schema"}, schemaId},
+		nil, []data.Order{{"", "path", false},
+			{"", "attr", false}}, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []IgnoreRule
+	for rows.Next() {
+		var rule IgnoreRule
+		if err = rows.Scan(
+			&rule.Path, &rule.Attr, &rule.Mode); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, rows.Err()
+}
+
+// element path => attribute name (empty for subtree) => mode
+type ignoreRules map[string]map[string]int
+
+func loadIgnoreRules(
+	handle data.Handle, schemaId int) (ignoreRules, error) {
+	rules, err := findIgnoreRules(handle, schemaId)
+	if err != nil {
+		return nil, err
+	}
+
+	ignores := make(ignoreRules)
+	for _, r := range rules {
+		if _, ok := ignores[r.Path]; !ok {
+			ignores[r.Path] = make(map[string]int)
+		}
+		ignores[r.Path][r.Attr] = r.Mode
+	}
+
+	return ignores, nil
+}
+
+func (ignores ignoreRules) skips(path string) bool {
+	for p, attrs := range ignores {
+		if _, ok := attrs[""]; ok && (path == p ||
+			strings.HasPrefix(path, p+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// strips the attributes which are not to be stored
+func (ignores ignoreRules) filter(
+	path string, attrs []xml.Attr) []xml.Attr {
+	modes, ok := ignores[path]
+	if !ok {
+		return attrs
+	}
+
+	var filtered []xml.Attr
+	for _, a := range attrs {
+		if mode, ok := modes[a.Name.Local]; !ok || mode != IgnoreDrop {
+			filtered = append(filtered, a)
+		}
+	}
+	return filtered
+}
+
+func (ignores ignoreRules) keepsLatest(path string) bool {
+	for _, mode := range ignores[path] {
+		if mode == IgnoreLatest {
+			return true
+		}
+	}
+	return false
+}
+
+// Latest value of an attribute ignored with IgnoreLatest
+// differing from the one recorded by the element's last event.
+type LatestValue struct {
+	Path   string
+	Parent string // parent's monId value
+	MonId  string // element's monId value
+	Attr   string
+	Value  string
+	Time   time.Time // of the commit the value came with
+}
+
+func LatestValues(handle data.Handle, name string) ([]LatestValue, error) {
+	doc, err := FindDoc(handle, name)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := data.SelectRows(handle,
+		[]data.ColName{
+			{"mon_path", "path"},
+			{"mon_latest", "parent"},
+			{"mon_latest", "mon_id"},
+			{"mon_latest", "attr"},
+			{"mon_latest", "value"},
+			{"mon_latest", "time"}},
+		[]data.Join{
+			{"", "mon_latest", "path"},
+			{"id", "mon_path", ""}},
+		data.Eq{data.ColName{"mon_latest", "doc"}, doc.id},
+		nil, []data.Order{{"mon_path", "path", false},
+			{"mon_latest", "parent", false},
+			{"mon_latest", "mon_id", false},
+			{"mon_latest", "attr", false}}, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values []LatestValue
+	for rows.Next() {
+		var v LatestValue
+		if err = rows.Scan(&v.Path, &v.Parent, &v.MonId,
+			&v.Attr, &v.Value, &v.Time); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+
+	return values, rows.Err()
+}
+
+func latestWhere(context *commitContext,
+	path *path, parent, monIdValue string) interface{} {
+	return data.And{
+		data.And{data.Eq{data.ColName{"", "doc"}, context.doc},
+			data.Eq{data.ColName{"", "path"}, path.id}},
+		data.And{data.Eq{data.ColName{"", "parent"}, parent},
+			data.Eq{data.ColName{"", "mon_id"}, monIdValue}}}
+}
+
+// keeps the latest values of the ignored attributes of the otherwise
+// unchanged element apart from its events not to rewrite the history
+func keepLatest(context *commitContext, path *path,
+	parent, monIdValue string, element *element, attrs []xml.Attr) error {
+	if !context.latest {
+		return nil
+	}
+
+	for _, a := range attrs {
+		mode, ok := context.ignores[path.path][a.Name.Local]
+		if !ok || mode != IgnoreLatest {
+			continue
+		}
+
+		where := data.And{
+			latestWhere(context, path, parent, monIdValue),
+			data.Eq{data.ColName{"", "attr"}, a.Name.Local}}
+		err := data.DeleteRows(context.handle, "mon_latest", where)
+		if err != nil {
+			return err
+		}
+		if element.attrs[a.Name.Local] == a.Value {
+			continue
+		}
+
+		columns := map[string]interface{}{
+			"doc":    context.doc,
+			"path":   path.id,
+			"parent": parent,
+			"mon_id": monIdValue,
+			"attr":   a.Name.Local,
+			"value":  a.Value,
+			"time":   context.now,
+		}
+		_, err = data.InsertRow(
+			context.handle, "mon_latest", columns, "")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// drops the latest values once the element's event records them
+func clearLatest(context *commitContext,
+	path *path, parent, monIdValue string) error {
+	return data.DeleteRows(context.handle, "mon_latest",
+		latestWhere(context, path, parent, monIdValue))
+}
@@ -4,19 +4,22 @@ import (
 	"btc/data"
 )
 
-func Install(handle data.Handle) error {
-	columns := []data.Column{
+type table struct {
+	name    string
+	columns []data.Column
+	indexes []data.Index
+}
+
+// in the creation order (referenced tables first)
+var tables = []table{
+	{"mon_schema", []data.Column{
 		{"id", data.Integer, data.PrimaryKey, "", ""},
 		{"name", data.String, data.NotNull | data.Unique, "", ""},
 		{"desc", data.String, 0, "", ""},
-	}
-	indexes := []data.Index{{[]string{"name"}}}
-	if err := data.CreateTable(handle,
-		"mon_schema", columns, indexes); err != nil {
-		return err
-	}
+		{"version", data.Integer, data.NotNull, "", ""},
+	}, []data.Index{{[]string{"name"}}}},
 
-	columns = []data.Column{
+	{"mon_doc", []data.Column{
 		{"id", data.Integer, data.PrimaryKey, "", ""},
 		{"name", data.String, data.NotNull | data.Unique, "", ""},
 		{"schema", data.Integer, data.NotNull, "mon_schema", "id"},
@@ -24,22 +27,137 @@ func Install(handle data.Handle) error {
 		{"uperiod", data.Integer, data.NotNull, "", ""},
 		{"speriod", data.Integer, data.NotNull, "", ""},
 		{"utime", data.Time, 0, "", ""},
-	}
-	if err := data.CreateTable(
-		handle, "mon_doc", columns, indexes); err != nil {
-		return err
-	}
+		{"rperiod", data.Integer, data.NotNull, "", ""},
+	}, []data.Index{{[]string{"name"}}}},
 
-	columns = []data.Column{
+	{"mon_commit", []data.Column{
+		{"id", data.Integer, data.PrimaryKey, "", ""},
+		{"doc", data.Integer, data.NotNull, "mon_doc", "id"},
+		{"time", data.Time, data.NotNull, "", ""},
+		{"ctime", data.Time, data.NotNull, "", ""},
+		{"forced", data.Integer, data.NotNull, "", ""},
+	}, []data.Index{{[]string{"doc"}}}},
+
+	{"mon_path", []data.Column{
 		{"id", data.Integer, data.PrimaryKey, "", ""},
 		{"schema", data.Integer, data.NotNull, "mon_schema", "id"},
 		{"path", data.String, data.NotNull, "", ""},
 		{"mon_id", data.String, 0, "", ""},
+		{"version", data.Integer, data.NotNull, "", ""},
+		{"ctime", data.Time, data.NotNull, "", ""},
+		{"dtime", data.Time, 0, "", ""},
+	}, []data.Index{{[]string{"schema"}}}},
+
+	{"mon_latest", []data.Column{
+		{"id", data.Integer, data.PrimaryKey, "", ""},
+		{"doc", data.Integer, data.NotNull, "mon_doc", "id"},
+		{"path", data.Integer, data.NotNull, "mon_path", "id"},
+		{"parent", data.String, data.NotNull, "", ""},
+		{"mon_id", data.String, data.NotNull, "", ""},
+		{"attr", data.String, data.NotNull, "", ""},
+		{"value", data.String, data.NotNull, "", ""},
+		{"time", data.Time, data.NotNull, "", ""},
+	}, []data.Index{{[]string{"doc"}}}},
+
+	{"mon_ignore", []data.Column{
+		{"id", data.Integer, data.PrimaryKey, "", ""},
+		{"schema", data.Integer, data.NotNull, "mon_schema", "id"},
+		{"path", data.String, data.NotNull, "", ""},
+		{"attr", data.String, data.NotNull, "", ""},
+		{"mode", data.Integer, data.NotNull, "", ""},
+	}, []data.Index{{[]string{"schema"}}}},
+
+	{"mon_deadband", []data.Column{
+		{"id", data.Integer, data.PrimaryKey, "", ""},
+		{"schema", data.Integer, data.NotNull, "mon_schema", "id"},
+		{"path", data.String, data.NotNull, "", ""},
+		{"attr", data.String, data.NotNull, "", ""},
+		{"amount", data.Integer, data.NotNull, "", ""},
+		{"type", data.Integer, data.NotNull, "", ""},
+	}, []data.Index{{[]string{"schema"}}}},
+
+	{"mon_rule", []data.Column{
+		{"id", data.Integer, data.PrimaryKey, "", ""},
+		{"name", data.String, data.NotNull | data.Unique, "", ""},
+		{"schema", data.Integer, data.NotNull, "mon_schema", "id"},
+		{"path", data.String, data.NotNull, "", ""},
+		{"attr", data.String, data.NotNull, "", ""},
+		{"cond", data.Integer, data.NotNull, "", ""},
+		{"value", data.String, data.NotNull, "", ""},
+		{"commits", data.Integer, data.NotNull, "", ""},
+	}, []data.Index{{[]string{"schema"}}}},
+
+	{"mon_alert", []data.Column{
+		{"id", data.Integer, data.PrimaryKey, "", ""},
+		{"rule", data.Integer, data.NotNull, "mon_rule", "id"},
+		{"doc", data.Integer, data.NotNull, "mon_doc", "id"},
+		{"parent", data.String, data.NotNull, "", ""},
+		{"mon_id", data.String, data.NotNull, "", ""},
+		{"stime", data.Time, data.NotNull, "", ""},
+		{"otime", data.Time, 0, "", ""},
+		{"ctime", data.Time, 0, "", ""},
+	}, []data.Index{{[]string{"doc"}}, {[]string{"rule"}}}},
+}
+
+// columns added to the tables of the first version along with
+// the values (SQL literals) they take in the existing rows
+var addedColumns = []struct {
+	table  string
+	column data.Column
+	value  string // empty for NULL
+}{
+	{"mon_schema", data.Column{
+		"version", data.Integer, data.NotNull, "", ""}, "1"},
+	{"mon_path", data.Column{
+		"version", data.Integer, data.NotNull, "", ""}, "1"},
+	{"mon_path", data.Column{
+		"ctime", data.Time, data.NotNull, "", ""}, "'epoch'"},
+	{"mon_path", data.Column{"dtime", data.Time, 0, "", ""}, ""},
+	{"mon_commit", data.Column{
+		"forced", data.Integer, data.NotNull, "", ""}, "0"},
+	{"mon_doc", data.Column{
+		"rperiod", data.Integer, data.NotNull, "", ""}, "0"},
+}
+
+func Install(handle data.Handle) error {
+	for _, t := range tables {
+		if err := data.CreateTable(handle,
+			t.name, t.columns, t.indexes); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Brings the tables installed by an earlier version up to date:
+// creates the missing ones and adds the missing columns. Does
+// nothing if they are up to date already.
+func Migrate(handle data.Handle) error {
+	return data.Transact(handle, migrate)
+}
+
+func migrate(handle data.Handle) error {
+	for _, t := range tables {
+		exists, err := data.HasTable(handle, t.name)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+
+		if err = data.CreateTable(handle,
+			t.name, t.columns, t.indexes); err != nil {
+			return err
+		}
 	}
-	indexes = []data.Index{{[]string{"schema"}}}
-	if err := data.CreateTable(handle,
-		"mon_path", columns, indexes); err != nil {
-		return err
+
+	for _, c := range addedColumns {
+		if err := data.AddColumnIfMissing(handle,
+			c.table, c.column, c.value); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -0,0 +1,231 @@
+package mon
+
+import (
+	"btc/data"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+type Interval struct {
+	Doc    string
+	MonIds []string // as for ElementHistory
+	Start  time.Time
+	End    data.NullTime // invalid if still matching at `to`
+}
+
+// Finds the intervals within [from, to] (intervals in effect at `from`
+// start there) when the elements of the path matched the predicate
+// (like `@state='error' and @level>2`, see parseQuery) across all the
+// documents of the schema. Ordered by document name and start time.
+func FindIntervals(handle data.Handle, schemaName, pathStr,
+	predicate string, from, to time.Time) ([]Interval, error) {
+	preds, ok := parseQueryPreds(predicate)
+	if !ok {
+		return nil, fmt.Errorf("mon: invalid "+
+			"predicate (`%s`)", predicate)
+	}
+
+	schema, err := FindSchema(handle, schemaName)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []*path
+	if paths, err = findSchemaPaths(handle, schema.id); err != nil {
+		return nil, err
+	}
+	if paths, err = livePaths(schema, paths, from, to); err != nil {
+		return nil, err
+	}
+
+	var chain []*path // from the root down to the element
+	for _, p := range paths {
+		if p.path == pathStr || strings.HasPrefix(pathStr, p.path+"/") {
+			chain = append(chain, p)
+		}
+	}
+	if len(chain) == 0 || chain[len(chain)-1].path != pathStr {
+		return nil, fmt.Errorf("mon: element "+
+			"path (`%s`) not found", pathStr)
+	}
+	path := chain[len(chain)-1]
+
+	integers := make([]bool, len(preds))
+	for i := range preds {
+		if integers[i], err = preds[i].check(handle, path); err != nil {
+			return nil, err
+		}
+	}
+	matches := func(attrs map[string]string, value string) bool {
+		for i := range preds {
+			if !preds[i].matches(attrs, value, integers[i]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	var docs []*Doc
+	docs, err = findDocs(handle,
+		data.Eq{data.ColName{"mon_schema", "name"}, schemaName})
+	if err != nil {
+		return nil, err
+	}
+
+	var intervals []Interval
+	for _, d := range docs {
+		docIntervals, err := findDocIntervals(handle,
+			d, paths[0], chain, matches, from, to)
+		if err != nil {
+			return nil, err
+		}
+		sort.Stable(intervalsByStart(docIntervals))
+		intervals = append(intervals, docIntervals...)
+	}
+
+	return intervals, nil
+}
+
+func findDocIntervals(handle data.Handle, doc *Doc, root *path,
+	chain []*path, matches func(map[string]string, string) bool,
+	from, to time.Time) ([]Interval, error) {
+	target := chain[len(chain)-1]
+	state := make(pathState)
+	since := from // the documents may have no history by `from`
+	last, err := findLastSnapshot(handle, root, doc, from)
+	if err != nil {
+		return nil, err
+	}
+	if last.Valid {
+		since = last.Time
+		state, err = computePathState(
+			handle, target, doc.id, last.Time, from)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// a parent's monId value taking effect at the given time
+	type parentSince struct {
+		time   time.Time
+		parent string
+	}
+
+	// ancestor's monId value => its parent's ones (ordered by time)
+	ancestors := make(map[*path]map[string][]parentSince)
+	for _, p := range chain[:len(chain)-1] {
+		if !p.monId.Valid {
+			continue
+		}
+
+		var events []event
+		events, err = findPathEvents(
+			handle, p.id, doc.id, since, to, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		ancestors[p] = make(map[string][]parentSince)
+		for _, e := range events {
+			monIdVal := e.attrs[p.monId.String]
+			ancestors[p][monIdVal] = append(ancestors[p][monIdVal],
+				parentSince{e.time, e.parent})
+		}
+	}
+
+	// the ancestor's parent as of the time (the first one if later)
+	parentAt := func(p *path, monIdVal string, at time.Time) string {
+		var parent string
+		for i, s := range ancestors[p][monIdVal] {
+			if i != 0 && s.time.After(at) {
+				break
+			}
+			parent = s.parent
+		}
+		return parent
+	}
+
+	// parents without `monId` break the chain (left with empty values)
+	monIds := func(parent, monIdVal string, at time.Time) []string {
+		var values []string
+		if target.monId.Valid {
+			values = append(values, monIdVal)
+		}
+		for i := len(chain) - 2; i >= 0; i -= 1 {
+			if !chain[i].monId.Valid {
+				parent = ""
+				continue
+			}
+			values = append([]string{parent}, values...)
+			parent = parentAt(chain[i], parent, at)
+		}
+		return values
+	}
+
+	type elementKey struct {
+		parent   string
+		monIdVal string
+	}
+	var intervals []Interval
+	open := make(map[elementKey]int) // index of the open interval
+
+	for parent, parentState := range state {
+		for monIdVal, element := range parentState {
+			if !matches(element.attrs, element.value) {
+				continue
+			}
+			open[elementKey{parent, monIdVal}] = len(intervals)
+			intervals = append(intervals, Interval{doc.Name,
+				monIds(parent, monIdVal, from), from,
+				data.NullTime{}})
+		}
+	}
+
+	var snapshots []time.Time
+	snapshots, err = findEventTimes(handle, root, doc, from, to, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []Change
+	changes, err = diffPath(
+		handle, target, doc, state, from, to, snapshots)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range changes {
+		key := elementKey{c.Parent, c.MonId}
+		i, ok := open[key]
+		matching := c.Type != ChangeRemoved &&
+			matches(c.NewAttrs, c.NewValue)
+		switch {
+		case matching && !ok:
+			open[key] = len(intervals)
+			intervals = append(intervals, Interval{doc.Name,
+				monIds(c.Parent, c.MonId, c.Time), c.Time,
+				data.NullTime{}})
+		case !matching && ok:
+			intervals[i].End = data.NullTime{c.Time, true}
+			delete(open, key)
+		}
+	}
+
+	return intervals, nil
+}
+
+type intervalsByStart []Interval
+
+func (intervals intervalsByStart) Len() int {
+	return len(intervals)
+}
+
+func (intervals intervalsByStart) Swap(i, j int) {
+	intervals[i], intervals[j] = intervals[j], intervals[i]
+}
+
+func (intervals intervalsByStart) Less(i, j int) bool {
+	return intervals[i].Start.Before(intervals[j].Start)
+}
@@ -0,0 +1,112 @@
+package mon
+
+import (
+	"btc/data"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+type Notification struct {
+	Schema  string    `json:"schema"`
+	Doc     string    `json:"doc"`
+	Time    time.Time `json:"time"`
+	Added   int       `json:"added"`
+	Changed int       `json:"changed"`
+	Removed int       `json:"removed"`
+}
+
+// the channel name must be shorter than 64 bytes,
+// so the long schema names are replaced with hashes
+func notifyChannel(schema string) string {
+	if len(schema) < 64-len("mon_") {
+		return "mon_" + schema
+	}
+	hash := md5.Sum([]byte(schema))
+	return "mon_" + hex.EncodeToString(hash[:])
+}
+
+// notifies the schema subscribers of the commit once it's done
+func notifyCommit(handle data.Handle, schema *Schema,
+	doc *Doc, at time.Time, changes []Change) error {
+	n := Notification{schema.Name, doc.Name, at, 0, 0, 0}
+	for _, c := range changes {
+		switch c.Type {
+		case ChangeAdded:
+			n.Added += 1
+		case ChangeChanged:
+			n.Changed += 1
+		case ChangeRemoved:
+			n.Removed += 1
+		}
+	}
+
+	payload, err := json.Marshal(&n)
+	if err != nil {
+		return err
+	}
+
+	return data.Notify(handle,
+		notifyChannel(schema.Name), string(payload))
+}
+
+type Subscription struct {
+	Notifications <-chan Notification // to be read until closed
+	listener      *data.Listener
+	done          chan struct{} // closed by Close
+	closing       sync.Once
+}
+
+// Delivers notifications of the commits of the schemas' documents.
+// Commits made while the connection is being reestablished are missed.
+func Subscribe(connStr string, schemas ...string) (*Subscription, error) {
+	var channels []string
+	for _, s := range schemas {
+		channels = append(channels, notifyChannel(s))
+	}
+
+	listener, err := data.Listen(connStr, channels...)
+	if err != nil {
+		return nil, err
+	}
+
+	notifications := make(chan Notification)
+	done := make(chan struct{})
+	go func() {
+		defer close(notifications)
+		for {
+			n, ok := listener.Receive()
+			if !ok {
+				return
+			}
+
+			var notification Notification
+			err := json.Unmarshal([]byte(n.Payload), &notification)
+			if err != nil {
+				continue
+			}
+
+			// not to block forever if nobody reads anymore
+			select {
+			case notifications <- notification:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return &Subscription{notifications,
+		listener, done, sync.Once{}}, nil
+}
+
+// Stops the notifications, repeated calls do nothing.
+func (subscription *Subscription) Close() error {
+	var err error
+	subscription.closing.Do(func() {
+		close(subscription.done)
+		err = subscription.listener.Close()
+	})
+	return err
+}
@@ -2,35 +2,187 @@ package mon
 
 import (
 	"btc/data"
+	"btc/xmls"
 	"database/sql"
 	"encoding/xml"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
 type path struct {
-	id     int
-	schema int
-	path   string
-	monId  sql.NullString
+	id      int
+	schema  int
+	path    string
+	monId   sql.NullString
+	version int       // schema version the path was added in
+	ctime   time.Time // creation time
+	dtime   data.NullTime
+	columns map[string]string // event table column types, loaded lazily
+}
+
+func (path *path) hasColumn(handle data.Handle, name string) (bool, error) {
+	type_, err := path.columnType(handle, name)
+	return len(type_) != 0, err
+}
+
+// database type name of the event table column (empty if none)
+func (path *path) columnType(
+	handle data.Handle, name string) (string, error) {
+	if err := path.loadColumns(handle); err != nil {
+		return "", err
+	}
+	return path.columns[name], nil
+}
+
+func (path *path) loadColumns(handle data.Handle) error {
+	if path.columns != nil {
+		return nil
+	}
+
+	rows, err := data.SelectRows(handle, []data.ColName{{"", ""}},
+		[]data.Join{{"", "mon_path_" + fmt.Sprint(path.id), ""}},
+		nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var cols []*sql.ColumnType
+	if cols, err = rows.ColumnTypes(); err != nil {
+		return err
+	}
+
+	path.columns = make(map[string]string)
+	for _, c := range cols {
+		path.columns[c.Name()] = c.DatabaseTypeName()
+	}
+
+	return nil
+}
+
+type PathInfo struct {
+	Path       string
+	MonId      string // empty if the element has no `monId`
+	HasValue   bool
+	ValueType  int // xmls.String or xmls.Integer
+	Attributes []xmls.Attribute
+	Version    int // schema version the path was added in
+}
+
+// Lists the element paths of the current schema version.
+func SchemaPaths(handle data.Handle, name string) ([]PathInfo, error) {
+	schema, err := FindSchema(handle, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []*path
+	paths, err = findSchemaPaths(handle, schema.id)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if paths, err = livePaths(schema, paths, now, now); err != nil {
+		return nil, err
+	}
+
+	valueType := func(type_ string) int {
+		if data.ColumnTypeOf(type_) == data.Integer {
+			return xmls.Integer
+		}
+		return xmls.String
+	}
+
+	var infos []PathInfo
+	for _, p := range paths {
+		if err = p.loadColumns(handle); err != nil {
+			return nil, err
+		}
+
+		info := PathInfo{p.path, p.monId.String,
+			false, xmls.String, nil, p.version}
+		if type_, ok := p.columns["value"]; ok {
+			info.HasValue = true
+			info.ValueType = valueType(type_)
+		}
+
+		var names []string
+		for c := range p.columns {
+			if strings.HasPrefix(c, "attr_") {
+				names = append(names, c)
+			}
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			info.Attributes = append(info.Attributes,
+				xmls.Attribute{n[5:], valueType(p.columns[n])})
+		}
+
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
+
+// finds the document, its schema and the paths
+// of the schema versions in effect within [from, to]
+func findDocPaths(handle data.Handle, name string,
+	from, to time.Time) (*Doc, *Schema, []*path, error) {
+	doc, err := FindDoc(handle, name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	schema, paths, err := findDocPathsAt(handle, doc, from, to)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return doc, schema, paths, nil
+}
+
+func findDocPathsAt(handle data.Handle,
+	doc *Doc, from, to time.Time) (*Schema, []*path, error) {
+	schema, err := FindSchema(handle, doc.Schema)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var paths []*path
+	paths, err = findSchemaPaths(handle, schema.id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	paths, err = livePaths(schema, paths, from, to)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return schema, paths, nil
 }
 
 func findSchemaPaths(handle data.Handle, schemaId int) ([]*path, error) {
 	rows, err := data.SelectRows(handle,
-		[]data.ColName{{"", "id"}, {"", "path"}, {"", "mon_id"}},
+		[]data.ColName{{"", "id"}, {"", "path"}, {"", "mon_id"},
+			{"", "version"}, {"", "ctime"}, {"", "dtime"}},
 		[]data.Join{{"", "mon_path", ""}},
 		data.Eq{data.ColName{"", "schema"}, schemaId},
 		nil, []data.Order{{"", "path", false}}, -1)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	var paths []*path
 	for rows.Next() {
 		var path path
-		if err = rows.Scan(
-			&path.id, &path.path, &path.monId); err != nil {
+		if err = rows.Scan(&path.id, &path.path, &path.monId,
+			&path.version, &path.ctime, &path.dtime); err != nil {
 			return nil, err
 		}
 		path.schema = schemaId
@@ -40,6 +192,25 @@ func findSchemaPaths(handle data.Handle, schemaId int) ([]*path, error) {
 	return paths, nil
 }
 
+// paths of the schema versions in effect within [from, to]
+func livePaths(schema *Schema,
+	paths []*path, from, to time.Time) ([]*path, error) {
+	var live []*path
+	for _, p := range paths {
+		if !p.ctime.After(to) &&
+			(!p.dtime.Valid || p.dtime.Time.After(from)) {
+			live = append(live, p)
+		}
+	}
+
+	if len(live) == 0 {
+		return nil, fmt.Errorf("mon: no element paths "+
+			"for schema (`%s`) at `%s`", schema.Name, to.String())
+	}
+
+	return live, nil
+}
+
 func filterPaths(paths []*path, prefix string) []*path {
 	var filtered []*path
 	for _, p := range paths {
@@ -77,21 +248,79 @@ func groupPaths(paths []*path) (string, [][]*path) {
 type element struct {
 	attrs    map[string]string
 	value    string
+	valued   bool      // the value is recorded, even if empty
+	pos      int       // -1 if unknown
+	time     time.Time // of the last event
 	preserve bool
 }
 
-func (element *element) isChanged(attrs []xml.Attr, value string) bool {
-	if element.value != value || len(element.attrs) != len(attrs) {
+// attributes having an ignore mode are not compared, while ones
+// having a deadband are compared with its tolerance; positions are
+// not compared either not to report a change for every following
+// sibling of an added element (see commitPath)
+func (element *element) isChanged(attrs []xml.Attr, value string,
+	ignored map[string]int, bands map[string]*Deadband) bool {
+	differs := func(band *Deadband, old, new_ string) bool {
+		return old != new_ &&
+			(band == nil || !band.suppresses(old, new_))
+	}
+
+	if differs(bands[""], element.value, value) {
 		return true
 	}
 
+	count := 0
 	for _, a := range attrs {
-		if element.attrs[a.Name.Local] != a.Value {
+		if _, ok := ignored[a.Name.Local]; ok {
+			continue
+		}
+		v, ok := element.attrs[a.Name.Local]
+		if !ok || differs(bands[a.Name.Local], v, a.Value) {
 			return true
 		}
+		count += 1
+	}
+
+	for n := range element.attrs {
+		if _, ok := ignored[n]; !ok {
+			count -= 1
+		}
+	}
+
+	return count != 0
+}
+
+// compares attributes and values disregarding positions
+func (element *element) equals(other *element) bool {
+	if element.value != other.value ||
+		len(element.attrs) != len(other.attrs) {
+		return false
+	}
+
+	for n, v := range other.attrs {
+		if a, ok := element.attrs[n]; !ok || a != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+func sortedAttrNames(attrs map[string]string) []string {
+	var names []string
+	for n := range attrs {
+		names = append(names, n)
 	}
+	sort.Strings(names)
+	return names
+}
 
-	return false
+func (element *element) xmlAttrs() []xml.Attr {
+	var attrs []xml.Attr
+	for n, v := range element.attrs {
+		attrs = append(attrs, xml.Attr{xml.Name{"", n}, v})
+	}
+	return attrs
 }
 
 // element's monId value => element
@@ -105,32 +334,89 @@ type docState map[*path]pathState
 
 func findSnapshot(handle data.Handle,
 	path *path, doc *Doc, from time.Time) (time.Time, error) {
+	stime, err := findLastSnapshot(handle, path, doc, from)
+	if err != nil {
+		return from, err
+	}
+	if !stime.Valid {
+		return from, noSnapshotError(doc, from)
+	}
+
+	return stime.Time, nil
+}
+
+// the time to read the events from to get the state at `at`, which
+// is `at` itself (so nothing is read) before the first snapshot
+func findStartSnapshot(handle data.Handle,
+	path *path, doc *Doc, at time.Time) (time.Time, error) {
+	stime, err := findLastSnapshot(handle, path, doc, at)
+	if err != nil || !stime.Valid {
+		return at, err
+	}
+	return stime.Time, nil
+}
+
+func noSnapshotError(doc *Doc, from time.Time) error {
+	return fmt.Errorf("mon: no snapshot found "+
+		"for document (`%s`) before `%s`", doc.Name, from.String())
+}
+
+// the time of the last snapshot (if any) not after `from`
+func findLastSnapshot(handle data.Handle,
+	path *path, doc *Doc, from time.Time) (data.NullTime, error) {
 	docWhere := data.Eq{doc.id, data.ColName{"", "doc"}}
 	timeWhere := data.Ge{from, data.ColName{"", "time"}}
 	eventWhere := data.Eq{snapshot, data.ColName{"", "event"}}
 	snapshotWhere := data.And{docWhere, data.And{timeWhere, eventWhere}}
 
 	rows, err := data.SelectRows(handle,
-		[]data.Aggr{{"", "time", data.Max}},
+		[]data.Aggr{{"", "time", data.Max, ""}},
 		[]data.Join{{"", "mon_path_" + fmt.Sprint(path.id), ""}},
 		snapshotWhere, nil, nil, -1)
 	if err != nil {
-		return from, err
+		return data.NullTime{}, err
 	}
 	defer rows.Close()
 
 	rows.Next()
 	var stime data.NullTime
-	if err = rows.Scan(&stime); err != nil {
-		return from, err
+	err = rows.Scan(&stime)
+	return stime, err
+}
+
+// distinct event (or snapshot only) times within (from, to]
+func findEventTimes(handle data.Handle, path *path, doc *Doc,
+	from, to time.Time, snapshotsOnly bool) ([]time.Time, error) {
+	docWhere := data.Eq{doc.id, data.ColName{"", "doc"}}
+	fromWhere := data.Gr{data.ColName{"", "time"}, from}
+	toWhere := data.Ge{to, data.ColName{"", "time"}}
+	var eventsWhere interface{} = data.And{docWhere,
+		data.And{fromWhere, toWhere}}
+	if snapshotsOnly {
+		eventsWhere = data.And{eventsWhere,
+			data.Eq{snapshot, data.ColName{"", "event"}}}
 	}
-	if !stime.Valid {
-		return from, fmt.Errorf("mon: no snapshot found "+
-			"for document (`%s`) before `%s`",
-			doc.Name, from.String())
+
+	rows, err := data.SelectRows(handle,
+		[]data.ColName{{"", "time"}},
+		[]data.Join{{"", "mon_path_" + fmt.Sprint(path.id), ""}},
+		eventsWhere, []data.ColName{{"", "time"}},
+		[]data.Order{{"", "time", false}}, -1)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	return stime.Time, nil
+	var times []time.Time
+	for rows.Next() {
+		var time_ time.Time
+		if err = rows.Scan(&time_); err != nil {
+			return nil, err
+		}
+		times = append(times, time_)
+	}
+
+	return times, rows.Err()
 }
 
 const ( // event types
@@ -146,43 +432,54 @@ type event struct {
 	event  int
 	parent string
 	value  string
+	valued bool // the value is recorded, even if empty
+	pos    int
 	attrs  map[string]string
+	rev    int // zero if not in the feed
 }
 
-func findPathEvents(handle data.Handle,
-	path, doc int, from, to time.Time) ([]event, error) {
+// only the events matching the filter (if not nil) are found
+func findPathEvents(handle data.Handle, path, doc int,
+	from, to time.Time, filter interface{}) ([]event, error) {
 	docWhere := data.Eq{doc, data.ColName{"", "doc"}}
 	fromWhere := data.Ge{data.ColName{"", "time"}, from}
 	toWhere := data.Ge{to, data.ColName{"", "time"}}
-	eventsWhere := data.And{docWhere, data.And{fromWhere, toWhere}}
+	var eventsWhere interface{} = data.And{docWhere,
+		data.And{fromWhere, toWhere}}
+	if filter != nil {
+		eventsWhere = data.And{eventsWhere, filter}
+	}
+
+	return selectPathEvents(handle, path, eventsWhere)
+}
 
+// events ordered by time
+func selectPathEvents(handle data.Handle,
+	path int, where interface{}) ([]event, error) {
 	rows, err := data.SelectRows(handle, []data.ColName{{"", ""}},
 		[]data.Join{{"", "mon_path_" + fmt.Sprint(path), ""}},
-		eventsWhere, nil, []data.Order{{"", "time", false}}, -1)
+		where, nil, []data.Order{{"", "time", false}}, -1)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	var cols []string
 	if cols, err = rows.Columns(); err != nil {
 		return nil, err
 	}
-	for i := range cols {
-		if strings.HasPrefix(cols[i], "attr_") {
-			cols[i] = cols[i][5:]
-		}
-	}
-
+	// the rest of the columns are optional, so matched by name
 	fixedCount := 3
 	params := make([]interface{}, len(cols))
-	values := make([]sql.NullString, len(cols)-fixedCount)
-	for i := 0; i < len(cols)-fixedCount; i += 1 {
-		params[fixedCount+i] = &values[i]
+	values := make([]sql.NullString, len(cols))
+	for i := fixedCount; i < len(cols); i += 1 {
+		params[i] = &values[i]
 	}
 
 	var events []event
 	for rows.Next() {
 		var event event
+		event.pos = -1
 		event.attrs = make(map[string]string)
 
 		params[0], params[1], params[2] =
@@ -191,60 +488,92 @@ func findPathEvents(handle data.Handle,
 			return nil, err
 		}
 
-		i := 0
-		if fixedCount+i < len(cols) &&
-			cols[fixedCount+i] == "parent" {
-			if values[i].Valid {
-				event.parent = values[i].String
+		for i := fixedCount; i < len(cols); i += 1 {
+			if !values[i].Valid {
+				continue
 			}
-			i += 1
-		}
-		if fixedCount+i < len(cols) &&
-			cols[fixedCount+i] == "value" {
-			if values[i].Valid {
+			switch {
+			case strings.HasPrefix(cols[i], "attr_"):
+				event.attrs[cols[i][5:]] = values[i].String
+			case cols[i] == "parent":
+				event.parent = values[i].String
+			case cols[i] == "value":
 				event.value = values[i].String
-			}
-			i += 1
-		}
-
-		for ; i < len(values); i += 1 {
-			if values[i].Valid {
-				event.attrs[cols[fixedCount+i]] =
-					values[i].String
+				event.valued = true
+			case cols[i] == "pos":
+				event.pos, err = strconv.Atoi(values[i].String)
+				if err != nil {
+					return nil, err
+				}
+			case cols[i] == "rev":
+				event.rev, err = strconv.Atoi(values[i].String)
+				if err != nil {
+					return nil, err
+				}
+			case cols[i] == "empty":
+				markers := strings.Fields(values[i].String)
+				for _, c := range markers {
+					if strings.HasPrefix(c, "attr_") {
+						event.attrs[c[5:]] = ""
+					} else if c == "value" {
+						event.valued = true
+					}
+				}
 			}
 		}
 
 		events = append(events, event)
 	}
 
-	return events, nil
+	return events, rows.Err()
 }
 
 func computePathState(handle data.Handle,
 	path *path, doc int, from, to time.Time) (pathState, error) {
-	events, err := findPathEvents(handle, path.id, doc, from, to)
+	return computeFilteredPathState(handle, path, doc, from, to, nil)
+}
+
+// the path state at `to` computed since the last snapshot before
+// (empty if there's none, i.e. the document had no history by then)
+func computePathStateSince(handle data.Handle, path *path,
+	doc int, lastSnapshot data.NullTime, to time.Time) (pathState, error) {
+	if !lastSnapshot.Valid {
+		return make(pathState), nil
+	}
+	return computePathState(handle, path, doc, lastSnapshot.Time, to)
+}
+
+func computeFilteredPathState(handle data.Handle, path *path,
+	doc int, from, to time.Time, filter interface{}) (pathState, error) {
+	events, err := findPathEvents(
+		handle, path.id, doc, from, to, filter)
 	if err != nil {
 		return nil, err
 	}
 
 	state := make(pathState)
-	for _, e := range events {
-		monIdVal := ""
-		if path.monId.Valid {
-			monIdVal = e.attrs[path.monId.String]
-		}
-
-		switch e.event {
-		case snapshot, addition, change:
-			if _, ok := state[e.parent]; !ok {
-				state[e.parent] = make(parentState)
-			}
-			state[e.parent][monIdVal] =
-				&element{e.attrs, e.value, false}
-		case removal:
-			delete(state[e.parent], monIdVal)
-		}
+	for i := range events {
+		applyEvent(state, path, &events[i])
 	}
 
 	return state, nil
 }
+
+func applyEvent(state pathState, path *path, e *event) {
+	monIdVal := ""
+	if path.monId.Valid {
+		monIdVal = e.attrs[path.monId.String]
+	}
+
+	switch e.event {
+	case snapshot, addition, change:
+		if _, ok := state[e.parent]; !ok {
+			state[e.parent] = make(parentState)
+		}
+		state[e.parent][monIdVal] =
+			&element{e.attrs, e.value,
+				e.valued, e.pos, e.time, false}
+	case removal:
+		delete(state[e.parent], monIdVal)
+	}
+}
@@ -0,0 +1,261 @@
+package mon
+
+import (
+	"btc/data"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type PollStatus struct {
+	LastFetch   time.Time // last fetch attempt
+	LastSuccess time.Time
+	LastError   error
+	Failures    int // consecutive failures
+}
+
+// Periodically fetches every document from its URL and commits it.
+type Poller struct {
+	handle     data.Handle
+	client     *http.Client
+	MaxBackoff time.Duration
+	MaxSize    int64         // of a fetched document in bytes
+	Reload     time.Duration // period of reloading the documents
+	mutex      sync.Mutex
+	status     map[string]*PollStatus
+	cancel     context.CancelFunc
+	wait       sync.WaitGroup
+	loadDocs   func() ([]*Doc, error)
+	commit     func(name string, reader io.Reader, snapshot bool) error
+}
+
+// The handle must be safe for concurrent use (e.g. *sql.DB).
+func NewPoller(handle data.Handle, client *http.Client) *Poller {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	poller := &Poller{handle, client, time.Hour, 64 << 20, time.Minute,
+		sync.Mutex{}, make(map[string]*PollStatus), nil,
+		sync.WaitGroup{}, nil, nil}
+	poller.loadDocs = func() ([]*Doc, error) {
+		return findDocs(handle, nil)
+	}
+	poller.commit = func(
+		name string, reader io.Reader, snapshot bool) error {
+		return CommitDoc(handle, name, reader, snapshot)
+	}
+
+	return poller
+}
+
+func (poller *Poller) Start() error {
+	if poller.cancel != nil {
+		return fmt.Errorf("mon: poller already started")
+	}
+
+	docs, err := poller.loadDocs()
+	if err != nil {
+		return err
+	}
+
+	var ctx context.Context
+	ctx, poller.cancel = context.WithCancel(context.Background())
+	poller.wait.Add(1)
+	go poller.run(ctx, docs)
+
+	return nil
+}
+
+// Stops polling, aborting fetches in progress, and waits
+// for all the documents (being committed) to finish.
+func (poller *Poller) Stop() {
+	if poller.cancel == nil {
+		return
+	}
+	poller.cancel()
+	poller.wait.Wait()
+	poller.cancel = nil
+}
+
+func (poller *Poller) Status(name string) (PollStatus, bool) {
+	poller.mutex.Lock()
+	defer poller.mutex.Unlock()
+
+	status, ok := poller.status[name]
+	if !ok {
+		return PollStatus{}, false
+	}
+	return *status, true
+}
+
+// a document being polled
+type polledDoc struct {
+	doc    *Doc
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// polls the documents reloading them periodically, so the added
+// ones get polled and the changed ones are polled as changed
+func (poller *Poller) run(ctx context.Context, docs []*Doc) {
+	defer poller.wait.Done()
+
+	polled := make(map[string]*polledDoc)
+	for {
+		poller.schedule(ctx, polled, docs)
+
+		timer := time.NewTimer(poller.Reload)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		// the known documents are polled until reloaded
+		if reloaded, err := poller.loadDocs(); err == nil {
+			docs = reloaded
+		}
+	}
+}
+
+func (poller *Poller) schedule(ctx context.Context,
+	polled map[string]*polledDoc, docs []*Doc) {
+	stop := func(name string) {
+		p := polled[name]
+		p.cancel()
+		<-p.done // not to commit the document concurrently
+		delete(polled, name)
+	}
+
+	present := make(map[string]bool)
+	for _, d := range docs {
+		present[d.Name] = true
+		if p, ok := polled[d.Name]; ok {
+			if p.doc.Url == d.Url &&
+				p.doc.UpdatePeriod == d.UpdatePeriod {
+				continue
+			}
+			stop(d.Name)
+		}
+
+		if d.UpdatePeriod <= 0 {
+			continue
+		}
+
+		docCtx, cancel := context.WithCancel(ctx)
+		p := &polledDoc{d, cancel, make(chan struct{})}
+		polled[d.Name] = p
+		poller.wait.Add(1)
+		go poller.poll(docCtx, d, p.done)
+	}
+
+	for name := range polled {
+		if !present[name] {
+			stop(name)
+		}
+	}
+}
+
+func (poller *Poller) poll(
+	ctx context.Context, doc *Doc, done chan struct{}) {
+	defer poller.wait.Done()
+	defer close(done)
+
+	period := time.Duration(doc.UpdatePeriod) * time.Second
+	snapshot := !doc.UpdateTime.Valid
+	var delay time.Duration
+	for {
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		err := poller.fetch(ctx, doc, snapshot)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			snapshot = false
+		}
+		delay = poller.record(doc.Name, err, period)
+	}
+}
+
+func (poller *Poller) fetch(
+	ctx context.Context, doc *Doc, snapshot bool) error {
+	req, err := http.NewRequest("GET", doc.Url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := poller.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("mon: unexpected status (`%s`) "+
+			"fetching document (`%s`)", resp.Status, doc.Name)
+	}
+
+	// read beforehand not to keep the commit waiting for a slow server
+	body, err := ioutil.ReadAll(
+		io.LimitReader(resp.Body, poller.MaxSize+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > poller.MaxSize {
+		return fmt.Errorf("mon: document (`%s`) exceeds "+
+			"size limit (`%d`)", doc.Name, poller.MaxSize)
+	}
+
+	return poller.commit(doc.Name, bytes.NewReader(body), snapshot)
+}
+
+// records a fetch result and returns the delay before the next one
+func (poller *Poller) record(
+	name string, err error, period time.Duration) time.Duration {
+	poller.mutex.Lock()
+	defer poller.mutex.Unlock()
+
+	status, ok := poller.status[name]
+	if !ok {
+		status = &PollStatus{}
+		poller.status[name] = status
+	}
+
+	status.LastFetch = time.Now()
+	status.LastError = err
+	if err == nil {
+		status.LastSuccess = status.LastFetch
+		status.Failures = 0
+		return period
+	}
+	status.Failures += 1
+
+	backoff := period
+	for i := 1; i < status.Failures; i += 1 {
+		if backoff *= 2; backoff >= poller.MaxBackoff {
+			break
+		}
+	}
+	if backoff > poller.MaxBackoff {
+		backoff = poller.MaxBackoff
+	}
+
+	// jitter within [backoff/2, backoff) to spread retries
+	jitter := rand.Int63n(int64(backoff/2) + 1)
+	return backoff/2 + time.Duration(jitter)
+}
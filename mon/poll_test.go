@@ -0,0 +1,165 @@
+package mon
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type committed struct {
+	name     string
+	body     string
+	snapshot bool
+}
+
+// a poller of the documents committing into the channel
+func newTestPoller(client *http.Client,
+	docs func() []*Doc) (*Poller, chan committed) {
+	commits := make(chan committed, 10)
+	poller := NewPoller(nil, client)
+	poller.loadDocs = func() ([]*Doc, error) {
+		return docs(), nil
+	}
+	poller.commit = func(
+		name string, reader io.Reader, snapshot bool) error {
+		body, err := ioutil.ReadAll(reader)
+		commits <- committed{name, string(body), snapshot}
+		return err
+	}
+	return poller, commits
+}
+
+func waitCommit(t *testing.T, commits chan committed) committed {
+	select {
+	case c := <-commits:
+		return c
+	case <-time.After(5 * time.Second):
+		t.Fatal("no commit")
+		return committed{}
+	}
+}
+
+func TestPollerCommitsAfterFailures(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&requests, 1) <= 2 {
+				http.Error(w, "busy",
+					http.StatusServiceUnavailable)
+				return
+			}
+			io.WriteString(w, "<etr/>")
+		}))
+	defer server.Close()
+
+	doc := NewDoc("etr1", "etr", server.URL, 60, 0)
+	poller, commits := newTestPoller(server.Client(),
+		func() []*Doc { return []*Doc{doc} })
+	poller.MaxBackoff = 50 * time.Millisecond
+	if err := poller.Start(); err != nil {
+		t.Fatal(err)
+	}
+	c := waitCommit(t, commits)
+	poller.Stop()
+
+	if c != (committed{"etr1", "<etr/>", true}) {
+		t.Errorf("unexpected commit %v", c)
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("%d requests instead of 3", n)
+	}
+
+	status, ok := poller.Status("etr1")
+	if !ok || status.Failures != 0 || status.LastError != nil ||
+		status.LastSuccess.IsZero() {
+		t.Errorf("unexpected status %v", status)
+	}
+}
+
+func TestPollerBacksOff(t *testing.T) {
+	poller := NewPoller(nil, nil)
+	poller.MaxBackoff = 4 * time.Second
+	period := time.Second
+
+	limits := []time.Duration{period, 2 * period,
+		4 * period, poller.MaxBackoff}
+	for i, limit := range limits {
+		delay := poller.record("etr1", errors.New("failed"), period)
+		if delay < limit/2 || delay > limit {
+			t.Errorf("failure %d: delay %s not within [%s, %s]",
+				i+1, delay, limit/2, limit)
+		}
+
+		status, _ := poller.Status("etr1")
+		if status.Failures != i+1 || status.LastError == nil {
+			t.Errorf("failure %d: unexpected status %v",
+				i+1, status)
+		}
+	}
+
+	if delay := poller.record("etr1", nil, period); delay != period {
+		t.Errorf("delay %s after success instead of %s", delay, period)
+	}
+}
+
+func TestPollerLimitsSize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "<etr>too long</etr>")
+		}))
+	defer server.Close()
+
+	poller, commits := newTestPoller(server.Client(), nil)
+	poller.MaxSize = 8
+	doc := NewDoc("etr1", "etr", server.URL, 60, 0)
+	if err := poller.fetch(
+		context.Background(), doc, false); err == nil {
+		t.Error("oversized document fetched")
+	}
+	if len(commits) != 0 {
+		t.Error("oversized document committed")
+	}
+}
+
+func TestPollerReloadsDocs(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "<"+r.URL.Path[1:]+"/>")
+		}))
+	defer server.Close()
+
+	var mutex sync.Mutex
+	var docs []*Doc
+	poller, commits := newTestPoller(server.Client(), func() []*Doc {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return docs
+	})
+	poller.Reload = 10 * time.Millisecond
+	if err := poller.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer poller.Stop()
+
+	mutex.Lock()
+	docs = []*Doc{NewDoc("etr1", "etr", server.URL+"/etr", 60, 0)}
+	mutex.Unlock()
+	if c := waitCommit(t, commits); c.body != "<etr/>" {
+		t.Errorf("unexpected commit %v", c)
+	}
+
+	// the changed URL is fetched at once
+	mutex.Lock()
+	docs = []*Doc{NewDoc("etr1", "etr", server.URL+"/etr2", 60, 0)}
+	mutex.Unlock()
+	if c := waitCommit(t, commits); c.body != "<etr2/>" {
+		t.Errorf("unexpected commit %v", c)
+	}
+}
@@ -0,0 +1,442 @@
+package mon
+
+import (
+	"btc/data"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Element found by Query.
+type QueryElement struct {
+	Path   string
+	Parent string // parent's monId value
+	MonId  string // element's monId value
+	Attrs  map[string]string
+	Value  string
+}
+
+// a comparison of a stored field with a constant
+type queryPred struct {
+	column string // `value` or `attr_*`
+	op     string
+	value  string
+}
+
+type queryStep struct {
+	name  string
+	preds []queryPred
+}
+
+// the longer ones go first not to be taken for their prefixes
+var queryOps = []string{"!=", "<=", ">=", "=", "<", ">"}
+
+// Parses queries like `/etr/input[@id=3]/check[@state!='ok']`,
+// predicates compare attributes (`@name`) or values (`.` or
+// `text()`) with constants (may be quoted) and can be joined
+// with `and`. Only integer fields are ordered (see check).
+func parseQuery(query string) ([]queryStep, error) {
+	invalid := fmt.Errorf("mon: invalid query (`%s`)", query)
+	if len(query) == 0 || query[0] != '/' {
+		return nil, invalid
+	}
+
+	var steps []queryStep
+	for _, s := range splitUnquoted(query[1:], "/") {
+		var step queryStep
+		if i := indexUnquoted(s, "["); i >= 0 {
+			preds := s[i:]
+			s = s[:i]
+			for len(preds) != 0 {
+				end := indexUnquoted(preds, "]")
+				if preds[0] != '[' || end < 0 {
+					return nil, invalid
+				}
+
+				parsed, ok := parseQueryPreds(preds[1:end])
+				if !ok {
+					return nil, invalid
+				}
+				step.preds = append(step.preds, parsed...)
+				preds = preds[end+1:]
+			}
+		}
+
+		if len(s) == 0 {
+			return nil, invalid
+		}
+		step.name = s
+		steps = append(steps, step)
+	}
+
+	return steps, nil
+}
+
+// parses predicates joined with `and`
+func parseQueryPreds(preds string) ([]queryPred, bool) {
+	var parsed []queryPred
+	for _, p := range splitUnquoted(preds, " and ") {
+		pred, ok := parseQueryPred(p)
+		if !ok {
+			return nil, false
+		}
+		parsed = append(parsed, pred)
+	}
+	return parsed, true
+}
+
+func parseQueryPred(pred string) (queryPred, bool) {
+	// the field goes first (the value may hold operators)
+	i := strings.IndexAny(pred, "!<>=")
+	if i < 0 {
+		return queryPred{}, false
+	}
+
+	for _, op := range queryOps {
+		if !strings.HasPrefix(pred[i:], op) {
+			continue
+		}
+
+		field := strings.TrimSpace(pred[:i])
+		value, ok := unquote(strings.TrimSpace(pred[i+len(op):]))
+		switch {
+		case !ok:
+			return queryPred{}, false
+		case field == "." || field == "text()":
+			return queryPred{"value", op, value}, true
+		case len(field) > 1 && field[0] == '@':
+			return queryPred{"attr_" + field[1:], op, value}, true
+		default:
+			return queryPred{}, false
+		}
+	}
+
+	return queryPred{}, false
+}
+
+// checks the predicate against the path, returns true
+// if the field is an integer one (as is the constant)
+func (pred *queryPred) check(
+	handle data.Handle, path *path) (bool, error) {
+	type_, err := path.columnType(handle, pred.column)
+	if err != nil {
+		return false, err
+	}
+	if len(type_) == 0 {
+		return false, fmt.Errorf("mon: no field (`%s`) for "+
+			"element path (`%s`)", pred.column, path.path)
+	}
+
+	// strings aren't ordered alike here and in the database
+	if data.ColumnTypeOf(type_) != data.Integer {
+		if pred.op != "=" && pred.op != "!=" {
+			return false, fmt.Errorf("mon: operator (`%s`) "+
+				"applied to non-integer field (`%s`) of "+
+				"element path (`%s`)", pred.op,
+				pred.column, path.path)
+		}
+		return false, nil
+	}
+	if _, err = strconv.Atoi(pred.value); err != nil {
+		return false, fmt.Errorf("mon: value (`%s`) compared "+
+			"with field (`%s`) of element path (`%s`) "+
+			"is not an integer", pred.value,
+			pred.column, path.path)
+	}
+	return true, nil
+}
+
+// evaluates the predicate on the element fields
+func (pred *queryPred) matches(
+	attrs map[string]string, value string, integer bool) bool {
+	if pred.column != "value" {
+		var ok bool
+		if value, ok = attrs[pred.column[5:]]; !ok {
+			return false
+		}
+	}
+
+	var cmp int
+	if integer {
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return false
+		}
+		c, _ := strconv.Atoi(pred.value)
+		switch {
+		case v < c:
+			cmp = -1
+		case v > c:
+			cmp = 1
+		}
+	} else if value != pred.value {
+		cmp = 1 // strings are only compared for equality
+	}
+
+	switch pred.op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+// the predicate on the field value of the last element event
+func (pred *queryPred) sqlExpr(
+	handle data.Handle, path *path) (interface{}, error) {
+	integer, err := pred.check(handle, path)
+	if err != nil {
+		return nil, err
+	}
+
+	var value interface{} = pred.value
+	if integer {
+		value, _ = strconv.Atoi(pred.value)
+	}
+
+	field := data.Aggr{"", pred.column, data.Last, "time"}
+	switch pred.op {
+	case "=":
+		return data.Eq{field, value}, nil
+	case "!=":
+		return data.Not{data.Eq{field, value}}, nil
+	case "<":
+		return data.Gr{value, field}, nil
+	case "<=":
+		return data.Ge{value, field}, nil
+	case ">":
+		return data.Gr{field, value}, nil
+	default:
+		return data.Ge{field, value}, nil
+	}
+}
+
+// Finds the elements matching the query (see parseQuery) as of the
+// given time (none before the first snapshot), the predicates are
+// evaluated by the database (but comparisons with empty strings).
+// Elements are told from their cousins by the parents' `monId`
+// values only and ordered by them.
+func Query(handle data.Handle, name, query string,
+	at time.Time) ([]QueryElement, error) {
+	steps, err := parseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, _, paths, err := findDocPaths(handle, name, at, at)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshot time.Time
+	snapshot, err = findStartSnapshot(handle, paths[0], doc, at)
+	if err != nil {
+		return nil, err
+	}
+
+	byPath := make(map[string]*path)
+	for _, p := range paths {
+		byPath[p.path] = p
+	}
+
+	// monId values of the previous step elements, nil if any
+	var parents map[string]bool
+	var elements []QueryElement
+	var pathStr string
+	for i, step := range steps {
+		pathStr += "/" + step.name
+		path, ok := byPath[pathStr]
+		if !ok {
+			return nil, fmt.Errorf("mon: element "+
+				"path (`%s`) not found", pathStr)
+		}
+
+		// no constraints on the children
+		if i != len(steps)-1 &&
+			len(step.preds) == 0 && parents == nil {
+			continue
+		}
+
+		elements, err = queryPathElements(handle,
+			path, doc, snapshot, at, step.preds, parents)
+		if err != nil {
+			return nil, err
+		}
+
+		parents = make(map[string]bool)
+		for _, e := range elements {
+			parents[e.MonId] = true
+		}
+	}
+
+	return elements, nil
+}
+
+// Counts the elements matching the query per parent's monId value.
+func QueryCount(handle data.Handle, name, query string,
+	at time.Time) (map[string]int, error) {
+	elements, err := Query(handle, name, query, at)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int)
+	for _, e := range elements {
+		counts[e.Parent] += 1
+	}
+
+	return counts, nil
+}
+
+// the elements present at the given time having one of the parents
+func queryPathElements(handle data.Handle, path *path, doc *Doc,
+	snapshot, at time.Time, preds []queryPred,
+	parents map[string]bool) ([]QueryElement, error) {
+	if err := path.loadColumns(handle); err != nil {
+		return nil, err
+	}
+
+	var keys []data.ColName
+	var orderBy []data.Order
+	hasParent := len(path.columns["parent"]) != 0
+	if hasParent {
+		keys = append(keys, data.ColName{"", "parent"})
+		orderBy = append(orderBy, data.Order{"", "parent", false})
+	}
+	monIdColumn := "attr_" + path.monId.String
+	if path.monId.Valid {
+		keys = append(keys, data.ColName{"", monIdColumn})
+		orderBy = append(orderBy, data.Order{"", monIdColumn, false})
+	}
+
+	// empty fields are NULL, but listed by the markers
+	var fields []string
+	for c := range path.columns {
+		if c == "value" || c == "empty" ||
+			strings.HasPrefix(c, "attr_") && c != monIdColumn {
+			fields = append(fields, c)
+		}
+	}
+	sort.Strings(fields)
+
+	var columns []interface{}
+	for _, k := range keys {
+		columns = append(columns, k)
+	}
+	columns = append(columns, data.Aggr{"", "event", data.Last, "time"})
+	for _, f := range fields {
+		columns = append(columns, data.Aggr{"", f, data.Last, "time"})
+	}
+
+	var where interface{} = data.And{
+		data.Eq{data.ColName{"", "doc"}, doc.id},
+		data.And{data.Ge{data.ColName{"", "time"}, snapshot},
+			data.Ge{at, data.ColName{"", "time"}}}}
+	if hasParent && len(parents) == 1 {
+		for p := range parents {
+			where = data.And{where,
+				data.Eq{data.ColName{"", "parent"}, p}}
+		}
+	}
+
+	// comparisons with empty strings (stored as NULL) are made here
+	var emptyPreds []queryPred
+	var having interface{} = data.Gr{removal,
+		data.Aggr{"", "event", data.Last, "time"}}
+	for i := range preds {
+		if len(preds[i].value) == 0 {
+			if _, err := preds[i].check(handle, path); err != nil {
+				return nil, err
+			}
+			emptyPreds = append(emptyPreds, preds[i])
+			continue
+		}
+
+		expr, err := preds[i].sqlExpr(handle, path)
+		if err != nil {
+			return nil, err
+		}
+		having = data.And{having, expr}
+	}
+
+	var groupBy interface{}
+	if len(keys) != 0 {
+		groupBy = keys
+	}
+
+	rows, err := data.SelectGroups(handle, columns,
+		[]data.Join{{"", "mon_path_" + fmt.Sprint(path.id), ""}},
+		where, groupBy, having, orderBy, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := make([]sql.NullString, len(columns))
+	params := make([]interface{}, len(columns))
+	for i := range values {
+		params[i] = &values[i]
+	}
+
+	var elements []QueryElement
+	for rows.Next() {
+		if err = rows.Scan(params...); err != nil {
+			return nil, err
+		}
+
+		element := QueryElement{path.path,
+			"", "", make(map[string]string), ""}
+		k := 0
+		if hasParent {
+			element.Parent = values[k].String
+			k += 1
+		}
+		if path.monId.Valid {
+			element.MonId = values[k].String
+			element.Attrs[path.monId.String] = values[k].String
+			k += 1
+		}
+		if parents != nil && !parents[element.Parent] {
+			continue
+		}
+
+		for i, f := range fields {
+			v := values[len(keys)+1+i]
+			switch {
+			case !v.Valid:
+			case f == "value":
+				element.Value = v.String
+			case f == "empty":
+				for _, c := range strings.Fields(v.String) {
+					if strings.HasPrefix(c, "attr_") {
+						element.Attrs[c[5:]] = ""
+					}
+				}
+			default:
+				element.Attrs[f[5:]] = v.String
+			}
+		}
+
+		matching := true
+		for i := range emptyPreds {
+			matching = matching && emptyPreds[i].matches(
+				element.Attrs, element.Value, false)
+		}
+		if matching {
+			elements = append(elements, element)
+		}
+	}
+
+	return elements, rows.Err()
+}
@@ -0,0 +1,117 @@
+package mon
+
+import (
+	"btc/data"
+	"fmt"
+)
+
+// tables having rows of documents (besides the event ones)
+var docTables = []string{"mon_commit", "mon_alert", "mon_latest"}
+
+// Removes the document along with its whole history.
+func RemoveDoc(handle data.Handle, name string) error {
+	return data.Transact(handle, func(handle data.Handle) error {
+		return removeDoc(handle, name)
+	})
+}
+
+func removeDoc(handle data.Handle, name string) error {
+	doc, err := FindDoc(handle, name)
+	if err != nil {
+		return err
+	}
+
+	schema, err := FindSchema(handle, doc.Schema)
+	if err != nil {
+		return err
+	}
+
+	var paths []*path
+	paths, err = findSchemaPaths(handle, schema.id)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range paths {
+		err = data.DeleteRows(handle, "mon_path_"+fmt.Sprint(p.id),
+			data.Eq{data.ColName{"", "doc"}, doc.id})
+		if err != nil {
+			return err
+		}
+	}
+
+	docWhere := data.Eq{data.ColName{"", "doc"}, doc.id}
+	for _, t := range docTables {
+		if err = data.DeleteRows(handle, t, docWhere); err != nil {
+			return err
+		}
+	}
+
+	return data.DeleteRows(handle, "mon_doc",
+		data.Eq{data.ColName{"", "id"}, doc.id})
+}
+
+// Removes the schema, refusing to do that if there are documents
+// of the schema unless forced to remove them as well.
+func RemoveSchema(handle data.Handle, name string, force bool) error {
+	return data.Transact(handle, func(handle data.Handle) error {
+		return removeSchema(handle, name, force)
+	})
+}
+
+func removeSchema(handle data.Handle, name string, force bool) error {
+	schema, err := FindSchema(handle, name)
+	if err != nil {
+		return err
+	}
+
+	var docs []*Doc
+	docs, err = findDocs(handle,
+		data.Eq{data.ColName{"mon_schema", "name"}, name})
+	if err != nil {
+		return err
+	}
+	if len(docs) != 0 && !force {
+		return fmt.Errorf("mon: schema (`%s`) is used "+
+			"by %d document(s)", name, len(docs))
+	}
+
+	for _, d := range docs {
+		docWhere := data.Eq{data.ColName{"", "doc"}, d.id}
+		for _, t := range docTables {
+			err = data.DeleteRows(handle, t, docWhere)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	var paths []*path
+	paths, err = findSchemaPaths(handle, schema.id)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range paths {
+		err = data.DropTable(handle, "mon_path_"+fmt.Sprint(p.id))
+		if err != nil {
+			return err
+		}
+	}
+
+	schemaWhere := data.Eq{data.ColName{"", "schema"}, schema.id}
+	for _, t := range []string{"mon_ignore", "mon_deadband", "mon_rule"} {
+		if err = data.DeleteRows(handle, t, schemaWhere); err != nil {
+			return err
+		}
+	}
+	if err = data.DeleteRows(handle, "mon_path", schemaWhere); err != nil {
+		return err
+	}
+	if err = data.DeleteRows(handle, "mon_doc", schemaWhere); err != nil {
+		return err
+	}
+
+	return data.DeleteRows(handle, "mon_schema",
+		data.Eq{data.ColName{"", "id"}, schema.id})
+}
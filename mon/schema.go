@@ -4,23 +4,33 @@ import (
 	"btc/data"
 	"btc/xmls"
 	"fmt"
+	"time"
 )
 
 type Schema struct {
-	id   int
-	Name string
-	Desc string
+	id      int
+	Name    string
+	Desc    string
+	Version int // incremented by UpgradeSchema
 }
 
 func NewSchema(name, desc string) *Schema {
-	return &Schema{0, name, desc}
+	return &Schema{0, name, desc, 1}
 }
 
 func AddSchema(handle data.Handle,
+	schema *Schema, root *xmls.Element) error {
+	return data.Transact(handle, func(handle data.Handle) error {
+		return addSchema(handle, schema, root)
+	})
+}
+
+func addSchema(handle data.Handle,
 	schema *Schema, root *xmls.Element) error {
 	columns := map[string]interface{}{
-		"name": schema.Name,
-		"desc": schema.Desc,
+		"name":    schema.Name,
+		"desc":    schema.Desc,
+		"version": schema.Version,
 	}
 	var err error
 	if schema.id, err = data.InsertRow(
@@ -28,61 +38,251 @@ func AddSchema(handle data.Handle,
 		return err
 	}
 
-	traverseFunc := func(
+	now := time.Now()
+	return root.Traverse(func(
 		element, parent *xmls.Element, path string) error {
-		columns := map[string]interface{}{
-			"schema": schema.id,
-			"path":   path,
-			"mon_id": data.ToNullString(element.MonId),
+		return addPath(handle, schema, now, element, parent, path)
+	})
+}
+
+func addPath(handle data.Handle, schema *Schema, ctime time.Time,
+	element, parent *xmls.Element, path string) error {
+	columns := map[string]interface{}{
+		"schema":  schema.id,
+		"path":    path,
+		"mon_id":  data.ToNullString(element.MonId),
+		"version": schema.Version,
+		"ctime":   ctime,
+	}
+
+	id, err := data.InsertRow(handle, "mon_path", columns, "id")
+	if err != nil {
+		return err
+	}
+
+	vtype := element.ValueType()
+	columns2 := []data.Column{
+		{"doc", data.Integer, data.NotNull, "mon_doc", "id"},
+		{"time", data.Time, data.NotNull, "", ""},
+		{"event", data.Integer, data.NotNull, "", ""},
+	}
+
+	if parent != nil && len(parent.MonId) != 0 {
+		atype := valueToDataType(parent.MonIdAttr().ValueType)
+		columns2 = append(columns2, data.Column{
+			"parent", atype, data.NotNull, "", ""})
+	}
+
+	if len(element.Children()) == 0 {
+		columns2 = append(columns2, data.Column{
+			"value", valueToDataType(vtype), 0, "", ""})
+	}
+
+	columns2 = append(columns2, markerColumns...)
+	columns2 = append(columns2, data.Column{
+		"pos", data.Integer, 0, "", ""})
+	columns2 = append(columns2, data.Column{
+		"rev", data.Integer, 0, "", ""})
+
+	indexes := []data.Index{
+		{[]string{"doc", "time"}},
+		{[]string{"rev"}},
+	}
+
+	for _, a := range element.Attributes() {
+		flags := 0
+		if a.Name == element.MonId {
+			flags = data.NotNull
 		}
+		vtype := valueToDataType(a.ValueType)
+		columns2 = append(columns2,
+			data.Column{"attr_" + a.Name,
+				vtype, flags, "", ""})
+	}
 
-		id, err := data.InsertRow(handle, "mon_path", columns, "id")
-		if err != nil {
-			return err
+	return data.CreateTable(handle,
+		"mon_path_"+fmt.Sprint(id), columns2, indexes)
+}
+
+// Brings the schema in line with the new root element: creates
+// tables for new paths, adds and widens (integer to string) columns
+// of existing ones and marks missing paths as dropped (keeping their
+// history). Dropped paths coming back are reopened. String fields
+// declared integer ones are kept as they are.
+func UpgradeSchema(handle data.Handle,
+	name string, root *xmls.Element) error {
+	return data.Transact(handle, func(handle data.Handle) error {
+		return upgradeSchema(handle, name, root)
+	})
+}
+
+func upgradeSchema(handle data.Handle,
+	name string, root *xmls.Element) error {
+	schema, err := FindSchema(handle, name)
+	if err != nil {
+		return err
+	}
+
+	var all, paths []*path
+	all, err = findSchemaPaths(handle, schema.id)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if paths, err = livePaths(schema, all, now, now); err != nil {
+		return err
+	}
+
+	current := make(map[string]*path)
+	for _, p := range paths {
+		current[p.path] = p
+	}
+	dropped := make(map[string]*path)
+	for _, p := range all {
+		if p.dtime.Valid && !p.dtime.Time.After(now) {
+			dropped[p.path] = p
 		}
+	}
 
-		vtype := element.ValueType()
-		columns2 := []data.Column{
-			{"doc", data.Integer, data.NotNull, "mon_doc", "id"},
-			{"time", data.Time, data.NotNull, "", ""},
-			{"event", data.Integer, data.NotNull, "", ""},
+	schema.Version += 1
+	traverseFunc := func(
+		element, parent *xmls.Element, pathStr string) error {
+		path, ok := current[pathStr]
+		if ok {
+			delete(current, pathStr)
+		} else if path, ok = dropped[pathStr]; ok {
+			err := reopenPath(handle, schema, paths[0], path)
+			if err != nil {
+				return err
+			}
+		} else {
+			return addPath(handle,
+				schema, now, element, parent, pathStr)
 		}
+		return upgradePath(handle, path, element, parent)
+	}
+	if err = root.Traverse(traverseFunc); err != nil {
+		return err
+	}
 
-		if parent != nil && len(parent.MonId) != 0 {
-			atype := valueToDataType(parent.MonIdAttr().ValueType)
-			columns2 = append(columns2, data.Column{
-				"parent", atype, data.NotNull, "", ""})
+	for _, p := range current {
+		err = data.UpdateRows(handle, "mon_path",
+			map[string]interface{}{"dtime": now},
+			data.Eq{data.ColName{"", "id"}, p.id})
+		if err != nil {
+			return err
 		}
+	}
+
+	return data.UpdateRows(handle, "mon_schema",
+		map[string]interface{}{"version": schema.Version},
+		data.Eq{data.ColName{"", "id"}, schema.id})
+}
 
-		if len(element.Children()) == 0 {
-			columns2 = append(columns2, data.Column{
-				"value", valueToDataType(vtype), 0, "", ""})
+// Makes the dropped path live again. As its elements are not
+// removed on dropping, removal events are added at the drop time
+// for the path to stay empty until now.
+func reopenPath(handle data.Handle,
+	schema *Schema, root, path *path) error {
+	docs, err := findDocs(handle,
+		data.Eq{data.ColName{"mon_schema", "name"}, schema.Name})
+	if err != nil {
+		return err
+	}
+
+	dtime := path.dtime.Time
+	for _, d := range docs {
+		var last data.NullTime
+		if last, err = findLastSnapshot(
+			handle, root, d, dtime); err != nil {
+			return err
 		}
 
-		indexes := []data.Index{
-			{[]string{"doc", "time"}},
+		context := newCommitContext(
+			handle, schema.id, d.id, false, last.Time, dtime)
+		context.state[path], err = computePathStateSince(
+			handle, path, d.id, last, dtime)
+		if err != nil {
+			return err
 		}
 
-		for _, a := range element.Attributes() {
-			flags := 0
-			if a.Name == element.MonId {
-				flags = data.NotNull
+		for parent, parentState := range context.state[path] {
+			for monIdValue := range parentState {
+				err = addEvent(context, path, removal,
+					parent, monIdValue, -1, nil, "")
+				if err != nil {
+					return err
+				}
 			}
-			vtype := valueToDataType(a.ValueType)
-			columns2 = append(columns2,
-				data.Column{"attr_" + a.Name,
-					vtype, flags, "", ""})
 		}
+	}
+
+	path.dtime = data.NullTime{}
+	return data.UpdateRows(handle, "mon_path",
+		map[string]interface{}{"dtime": path.dtime},
+		data.Eq{data.ColName{"", "id"}, path.id})
+}
+
+func upgradePath(handle data.Handle,
+	path *path, element, parent *xmls.Element) error {
+	if path.monId.String != element.MonId {
+		return fmt.Errorf("mon: changing `monId` attribute "+
+			"of element path (`%s`) not supported", path.path)
+	}
+
+	hasParent, err := path.hasColumn(handle, "parent")
+	if err != nil {
+		return err
+	}
+	if hasParent != (parent != nil && len(parent.MonId) != 0) {
+		return fmt.Errorf("mon: changing `monId` attribute "+
+			"of element path (`%s`) parent not supported",
+			path.path)
+	}
 
-		if err := data.CreateTable(handle, "mon_path_"+fmt.Sprint(id),
-			columns2, indexes); err != nil {
+	columns := append([]data.Column{}, markerColumns...)
+	columns = append(columns, data.Column{"rev", data.Integer, 0, "", ""})
+	if len(element.Children()) == 0 {
+		columns = append(columns, data.Column{"value",
+			valueToDataType(element.ValueType()), 0, "", ""})
+	}
+	for _, a := range element.Attributes() {
+		columns = append(columns, data.Column{"attr_" + a.Name,
+			valueToDataType(a.ValueType), 0, "", ""})
+	}
+
+	table := "mon_path_" + fmt.Sprint(path.id)
+	for _, c := range columns {
+		var type_ string
+		if type_, err = path.columnType(handle, c.Name); err != nil {
 			return err
 		}
 
-		return nil
+		// integers are converted to strings, but not back
+		if len(type_) == 0 {
+			err = data.AddColumn(handle, table, c)
+			if err == nil && c.Name == "rev" { // as for new tables
+				err = data.CreateIndex(handle,
+					table, data.Index{[]string{"rev"}})
+			}
+		} else if data.ColumnTypeOf(type_) == data.Integer &&
+			c.Type == data.String {
+			err = data.AlterColumnType(handle, table, c)
+		}
+		if err != nil {
+			return err
+		}
 	}
 
-	return root.Traverse(traverseFunc)
+	return nil
+}
+
+// events hold the full element state with NULL meaning absent (so
+// attributes removed by a change are NULL), hence this lists (space
+// separated) the columns (`value` or `attr_*`) present but empty
+var markerColumns = []data.Column{
+	{"empty", data.String, 0, "", ""},
 }
 
 func valueToDataType(xsdType int) int {
@@ -94,25 +294,45 @@ func valueToDataType(xsdType int) int {
 	}
 }
 
-func FindSchema(handle data.Handle, name string) (*Schema, error) {
+func findSchemas(
+	handle data.Handle, where interface{}) ([]*Schema, error) {
 	rows, err := data.SelectRows(handle,
-		[]data.ColName{{"", "id"}, {"", "desc"}},
+		[]data.ColName{{"", "id"}, {"", "name"},
+			{"", "desc"}, {"", "version"}},
 		[]data.Join{{"", "mon_schema", ""}},
-		data.Eq{data.ColName{"", "name"}, name}, nil, nil, -1)
+		where, nil, []data.Order{{"", "name", false}}, -1)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	if !rows.Next() {
-		return nil, fmt.Errorf("mon: schema (`%s`) not found", name)
+	var schemas []*Schema
+	for rows.Next() {
+		var schema Schema
+		if err = rows.Scan(&schema.id, &schema.Name,
+			&schema.Desc, &schema.Version); err != nil {
+			return nil, err
+		}
+		schemas = append(schemas, &schema)
 	}
 
-	var schema Schema
-	schema.Name = name
-	if err = rows.Scan(&schema.id, &schema.Desc); err != nil {
+	return schemas, rows.Err()
+}
+
+func FindSchema(handle data.Handle, name string) (*Schema, error) {
+	schemas, err := findSchemas(handle,
+		data.Eq{data.ColName{"", "name"}, name})
+	if err != nil {
 		return nil, err
 	}
 
-	return &schema, nil
+	if len(schemas) == 0 {
+		return nil, fmt.Errorf("mon: schema (`%s`) not found", name)
+	}
+
+	return schemas[0], nil
+}
+
+func ListSchemas(handle data.Handle) ([]*Schema, error) {
+	return findSchemas(handle, nil)
 }
@@ -0,0 +1,117 @@
+package mon
+
+import (
+	"fmt"
+	"strings"
+)
+
+// an element path step with an optional attribute predicate
+type selectorStep struct {
+	name  string
+	attr  string // empty if there's no predicate
+	value string
+}
+
+// Parses selectors like `/etr/input[@id=3]/check`, which are queries
+// (see parseQuery) with up to one attribute equality per step.
+func parseSelector(selector string) ([]selectorStep, error) {
+	invalid := fmt.Errorf("mon: invalid selector (`%s`)", selector)
+	queried, err := parseQuery(selector)
+	if err != nil {
+		return nil, invalid
+	}
+
+	var steps []selectorStep
+	for _, q := range queried {
+		step := selectorStep{q.name, "", ""}
+		switch {
+		case len(q.preds) == 0:
+		case len(q.preds) == 1 && q.preds[0].op == "=" &&
+			q.preds[0].column != "value":
+			step.attr = q.preds[0].column[len("attr_"):]
+			step.value = q.preds[0].value
+		default:
+			return nil, invalid
+		}
+		steps = append(steps, step)
+	}
+
+	return steps, nil
+}
+
+// the index of the first separator outside
+// the quotes in the string, -1 if there's none
+func indexUnquoted(s, sep string) int {
+	var quote byte
+	for i := 0; i < len(s); i += 1 {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case strings.HasPrefix(s[i:], sep):
+			return i
+		}
+	}
+	return -1
+}
+
+// splits the string around the separators outside the quotes
+func splitUnquoted(s, sep string) []string {
+	var parts []string
+	for i := indexUnquoted(s, sep); i >= 0; i = indexUnquoted(s, sep) {
+		parts = append(parts, s[:i])
+		s = s[i+len(sep):]
+	}
+	return append(parts, s)
+}
+
+// strips the quotes of the value, returns false
+// if they are unmatched (or unquoted ones are left)
+func unquote(value string) (string, bool) {
+	if len(value) == 0 || value[0] != '\'' && value[0] != '"' {
+		return value, strings.IndexAny(value, `'"`) < 0
+	}
+
+	end := len(value) - 1
+	if end == 0 || value[end] != value[0] ||
+		strings.IndexByte(value[1:end], value[0]) >= 0 {
+		return "", false
+	}
+	return value[1:end], true
+}
+
+// Leaves only the ancestors of the selected path, the path
+// itself and its subtree, returns the predicates by path.
+func selectPaths(paths []*path, steps []selectorStep) (
+	[]*path, map[string]*selectorStep, error) {
+	preds := make(map[string]*selectorStep)
+	var pathStr string
+	for i := range steps {
+		pathStr += "/" + steps[i].name
+		if len(steps[i].attr) != 0 {
+			preds[pathStr] = &steps[i]
+		}
+	}
+
+	found := false
+	var selected []*path
+	for _, p := range paths {
+		if p.path == pathStr {
+			found = true
+		}
+		if strings.HasPrefix(pathStr+"/", p.path+"/") ||
+			strings.HasPrefix(p.path, pathStr+"/") {
+			selected = append(selected, p)
+		}
+	}
+
+	if !found {
+		return nil, nil, fmt.Errorf("mon: element "+
+			"path (`%s`) not found", pathStr)
+	}
+
+	return selected, preds, nil
+}
@@ -0,0 +1,129 @@
+package mon
+
+import (
+	"btc/data"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+)
+
+type Point struct {
+	Time  time.Time
+	Value float64
+}
+
+type SeriesQuery struct {
+	Path   string
+	MonIds []string // as for ElementHistory
+	Attr   string   // attribute name or empty for the element value
+	From   time.Time
+	To     time.Time
+	Bucket time.Duration // no downsampling if zero
+	Aggr   int           // data.Max, data.Min, data.Avg or data.Last
+}
+
+// Returns the values recorded for an integer attribute (or value)
+// of a single element, optionally aggregated per time bucket.
+func Series(handle data.Handle,
+	name string, query *SeriesQuery) ([]Point, error) {
+	doc, _, paths, err := findDocPaths(
+		handle, name, query.From, query.To)
+	if err != nil {
+		return nil, err
+	}
+
+	path, parent, monIdVal, err := resolveElement(
+		paths, query.Path, query.MonIds)
+	if err != nil {
+		return nil, err
+	}
+
+	column := "value"
+	if len(query.Attr) != 0 {
+		column = "attr_" + query.Attr
+	}
+
+	var type_ string
+	if type_, err = path.columnType(handle, column); err != nil {
+		return nil, err
+	}
+	switch type_ {
+	case "INT2", "INT4", "INT8", "NUMERIC", "FLOAT4", "FLOAT8":
+	case "":
+		return nil, fmt.Errorf("mon: no field (`%s`) for "+
+			"element path (`%s`)", column, query.Path)
+	default:
+		return nil, fmt.Errorf("mon: field (`%s`) for element "+
+			"path (`%s`) is not numeric", column, query.Path)
+	}
+
+	// removal events carry no values
+	where := data.And{data.Eq{doc.id, data.ColName{"", "doc"}},
+		data.And{data.Ge{data.ColName{"", "time"}, query.From},
+			data.And{data.Ge{query.To, data.ColName{"", "time"}},
+				data.Gr{removal, data.ColName{"", "event"}}}}}
+	if len(parent) != 0 {
+		where = data.And{where,
+			data.Eq{data.ColName{"", "parent"}, parent}}
+	}
+	if path.monId.Valid {
+		where = data.And{where, data.Eq{data.ColName{
+			"", "attr_" + path.monId.String}, monIdVal}}
+	}
+
+	columns := []interface{}{
+		data.ColName{"", "time"}, data.ColName{"", column}}
+	var groupBy interface{}
+	if query.Bucket > 0 {
+		bucket := data.TimeBucket{"", "time",
+			int(query.Bucket / time.Second)}
+		if bucket.Seconds <= 0 {
+			return nil, fmt.Errorf("mon: series bucket "+
+				"(`%s`) shorter than a second", query.Bucket)
+		}
+		columns = []interface{}{bucket,
+			data.Aggr{"", column, query.Aggr, "time"}}
+		groupBy = []interface{}{bucket}
+	}
+
+	rows, err := data.SelectRows(handle, columns,
+		[]data.Join{{"", "mon_path_" + fmt.Sprint(path.id), ""}},
+		where, groupBy, nil, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var points []Point
+	for rows.Next() {
+		var time_ time.Time
+		var value sql.NullFloat64
+		if err = rows.Scan(&time_, &value); err != nil {
+			return nil, err
+		}
+		if value.Valid {
+			points = append(points, Point{time_, value.Float64})
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Sort(pointsByTime(points))
+	return points, nil
+}
+
+type pointsByTime []Point
+
+func (points pointsByTime) Len() int {
+	return len(points)
+}
+
+func (points pointsByTime) Swap(i, j int) {
+	points[i], points[j] = points[j], points[i]
+}
+
+func (points pointsByTime) Less(i, j int) bool {
+	return points[i].Time.Before(points[j].Time)
+}